@@ -22,6 +22,7 @@ import (
 	"github.com/spf13/cobra"
 
 	"github.com/vanilla-os/abroot/core"
+	"github.com/vanilla-os/abroot/settings"
 	"github.com/vanilla-os/orchid/cmdr"
 )
 
@@ -79,6 +80,9 @@ func pkg(cmd *cobra.Command, args []string) error {
 		cmdr.Error.Println(abroot.Trans("pkg.failedGettingPkgManagerInstance", err))
 		return err
 	}
+	if err := pkgM.ApiWarning(); err != nil {
+		cmdr.Warning.Println(abroot.Trans("pkg.apiMisconfigured"), err)
+	}
 
 	// Check for user agreement, here we could simply call the CheckStatus
 	// function which also checks if the package manager is enabled or not
@@ -114,6 +118,10 @@ func pkg(cmd *cobra.Command, args []string) error {
 		}
 	}
 
+	if pkgM.Offline() && (args[0] == "add" || args[0] == "remove") {
+		cmdr.Warning.Println(abroot.Trans("pkg.offlineWarning"))
+	}
+
 	switch args[0] {
 	case "add":
 		if len(args) < 2 {
@@ -123,8 +131,19 @@ func pkg(cmd *cobra.Command, args []string) error {
 			err := pkgM.Add(pkg)
 			if err != nil {
 				cmdr.Error.Println(err)
+				if settings.Cnf.IPkgMngApiIndex != "" {
+					for _, missing := range core.MissingPackages(err) {
+						suggestions, _ := pkgM.SuggestPackages(missing)
+						if len(suggestions) > 0 {
+							cmdr.Info.Println(abroot.Trans("pkg.didYouMean", missing, strings.Join(suggestions, ", ")))
+						}
+					}
+				}
 				return err
 			}
+			for _, violation := range pkgM.LastLicenseViolations() {
+				cmdr.Warning.Println(abroot.Trans("pkg.licenseNotAllowed", violation.Package, violation.License))
+			}
 		}
 		cmdr.Info.Printf(abroot.Trans("pkg.addedMsg"), strings.Join(args[1:], ", "))
 	case "remove":
@@ -137,6 +156,9 @@ func pkg(cmd *cobra.Command, args []string) error {
 				cmdr.Error.Println(err)
 				return err
 			}
+			for _, impact := range pkgM.LastRemovalImpacts() {
+				cmdr.Warning.Println(abroot.Trans("pkg.removalAffectsDependents", impact.Package, strings.Join(impact.Dependents, ", ")))
+			}
 		}
 		cmdr.Info.Printf(abroot.Trans("pkg.removedMsg"), strings.Join(args[1:], ", "))
 	case "list":
@@ -0,0 +1,143 @@
+package core
+
+/*	License: GPLv3
+	Authors:
+		Mirko Brombin <mirko@fabricators.ltd>
+		Vanilla OS Contributors <https://github.com/vanilla-os/>
+	Copyright: 2024
+	Description:
+		ABRoot is utility which provides full immutability and
+		atomicity to a Linux system, by transacting between
+		two root filesystems. Updates are performed using OCI
+		images, to ensure that the system is always in a
+		consistent state.
+*/
+
+import (
+	"context"
+	"strings"
+
+	"github.com/vanilla-os/abroot/settings"
+)
+
+// Backend abstracts the package manager of the distribution, so that
+// dnf, pacman or apk semantics can be plugged in without patching the
+// templates. InstallCmd and RemoveCmd return the argv of the command
+// installing or removing the given package names, or nil if there is
+// nothing to do, while ExistsInRepo reports whether a package can be
+// installed. Install options are apt-style and are not given to backends
+type Backend interface {
+	InstallCmd(pkgs []string) []string
+	RemoveCmd(pkgs []string) []string
+	ExistsInRepo(pkg string) error
+}
+
+// DefaultBackend is the default Backend, it appends the packages to the
+// iPkgMngAdd and iPkgMngRm commands and checks them against the repo API of
+// its package manager
+type DefaultBackend struct {
+	pm *PackageManager
+}
+
+// NewDefaultBackend returns the default Backend of the given package manager
+func NewDefaultBackend(p *PackageManager) *DefaultBackend {
+	return &DefaultBackend{pm: p}
+}
+
+// InstallCmd implements Backend
+func (b *DefaultBackend) InstallCmd(pkgs []string) []string {
+	return templateArgs(settings.Cnf.IPkgMngAdd, pkgs)
+}
+
+// RemoveCmd implements Backend
+func (b *DefaultBackend) RemoveCmd(pkgs []string) []string {
+	return templateArgs(settings.Cnf.IPkgMngRm, pkgs)
+}
+
+// ExistsInRepo implements Backend
+func (b *DefaultBackend) ExistsInRepo(pkg string) error {
+	_, err := b.pm.existsInRepoAPI(context.Background(), pkg, settings.Cnf.IPkgMngBranch)
+	return err
+}
+
+// templateArgs returns the argv of a command template followed by the given
+// packages, or nil if there are no packages
+func templateArgs(template string, pkgs []string) []string {
+	if len(pkgs) == 0 {
+		return nil
+	}
+
+	args, err := shellWords(template)
+	if err != nil {
+		args = strings.Fields(template)
+	}
+	for _, pkg := range pkgs {
+		args = append(args, formatPackageVersion(pkg))
+	}
+
+	return args
+}
+
+// SetBackend sets the backend building the package commands and checking
+// the packages in the repo, nil restores the templates and the repo API. A
+// CommandBuilder, if set, still takes precedence for the commands
+func (p *PackageManager) SetBackend(backend Backend) {
+	p.backend = backend
+}
+
+// backendCommandBuilder is the CommandBuilder in use when a Backend is set,
+// it chains the backend commands and wraps them with the pre/post hooks
+type backendCommandBuilder struct {
+	backend Backend
+}
+
+// Build implements CommandBuilder
+func (b backendCommandBuilder) Build(operation ABSystemOperation, add, remove []string) (string, error) {
+	addCmds := []string{}
+	for _, args := range backendCmds(b.backend.InstallCmd, add) {
+		addCmds = append(addCmds, joinArgs(args))
+	}
+	removeCmds := []string{}
+	for _, args := range backendCmds(b.backend.RemoveCmd, remove) {
+		removeCmds = append(removeCmds, joinArgs(args))
+	}
+
+	return composeCmd(strings.Join(addCmds, " && "), strings.Join(removeCmds, " && ")), nil
+}
+
+// backendCmds returns the argv of the commands a backend builds for the
+// given package entries, large package sets being split with the limits of
+// chunkPkgArgs. Backends are not given the install options, the entries
+// having some are reported with a verbose warning
+func backendCmds(cmd func(pkgs []string) []string, entries []string) [][]string {
+	names := [][]string{}
+	for _, entry := range entries {
+		entryNames, options := splitPackageOptions(entry)
+		if options != "" {
+			PrintVerboseWarn("PackageManager.backendCmds", 0, "install options are not supported by backends, dropping", options, "for", entryNames)
+		}
+		if fields := strings.Fields(entryNames); len(fields) > 0 {
+			names = append(names, fields)
+		}
+	}
+
+	cmds := [][]string{}
+	for _, chunk := range chunkPkgArgs("", names) {
+		if args := cmd(chunk); len(args) > 0 {
+			cmds = append(cmds, args)
+		}
+	}
+
+	return cmds
+}
+
+// joinArgs returns the shell form of the given argv, quoting the words when
+// needed
+func joinArgs(args []string) string {
+	words := []string{}
+	for _, arg := range args {
+		words = append(words, shellQuote(arg))
+	}
+
+	return strings.Join(words, " ")
+}
@@ -0,0 +1,266 @@
+package core
+
+/*	License: GPLv3
+	Authors:
+		Mirko Brombin <mirko@fabricators.ltd>
+		Vanilla OS Contributors <https://github.com/vanilla-os/>
+	Copyright: 2024
+	Description:
+		ABRoot is utility which provides full immutability and
+		atomicity to a Linux system, by transacting between
+		two root filesystems. Updates are performed using OCI
+		images, to ensure that the system is always in a
+		consistent state.
+*/
+
+import (
+	"context"
+	"slices"
+)
+
+// AddMany works like calling Add for each of the given packages, but reads
+// and writes the package files once and checks every package in the repo
+// only once. If any package fails the checks, the returned error names it and
+// no file is modified. The repo checks share a budget of IPkgMngRetryBudget
+// retries, so that a failing repo makes the remaining checks fail fast
+func (p *PackageManager) AddMany(pkgs []string) error {
+	PrintVerboseInfo("PackageManager.AddMany", "running...")
+
+	err := p.CheckStatus()
+	if err != nil {
+		PrintVerboseErr("PackageManager.AddMany", 0, err)
+		return err
+	}
+
+	pinned := []string{}
+	for _, pkg := range pkgs {
+		err = validatePackageName(pkg, true)
+		if err != nil {
+			PrintVerboseErr("PackageManager.AddMany", 0.05, err)
+			return err
+		}
+		pinned = append(pinned, pinPackageEntry(pkg))
+	}
+	pkgs = pinned
+
+	unlock, err := p.lockForAdd(withRetryBudget(context.Background()), pkgs...)
+	if err != nil {
+		PrintVerboseErr("PackageManager.AddMany", 0.1, err)
+		return err
+	}
+	defer unlock()
+
+	pkgsRemove, err := p.GetRemovePackages()
+	if err != nil {
+		PrintVerboseErr("PackageManager.AddMany", 1, err)
+		return err
+	}
+	pkgsAdd, err := p.GetAddPackages()
+	if err != nil {
+		PrintVerboseErr("PackageManager.AddMany", 2, err)
+		return err
+	}
+	upkgs, err := p.GetUnstagedPackages()
+	if err != nil {
+		PrintVerboseErr("PackageManager.AddMany", 3, err)
+		return err
+	}
+
+	addChanged, removeChanged := false, false
+	for _, pkg := range pkgs {
+		p.trace("add", pkg)
+		pkgName := packageKey(pkg)
+		upkgs = append(upkgs, UnstagedPackage{pkg, ADD})
+
+		// a package removed by the user is only unset from packages.remove
+		if i := slices.Index(pkgsRemove, pkgName); i != -1 {
+			pkgsRemove = slices.Delete(pkgsRemove, i, i+1)
+			removeChanged = true
+			continue
+		}
+
+		i := slices.IndexFunc(pkgsAdd, func(ap string) bool {
+			return packageKey(ap) == pkgName
+		})
+		switch {
+		case i == -1:
+			pkgsAdd = append(pkgsAdd, pkg)
+			addChanged = true
+		case pkgsAdd[i] != pkg:
+			pkgsAdd[i] = pkg
+			addChanged = true
+		}
+	}
+
+	err = p.writeUnstagedPackages(upkgs)
+	if err != nil {
+		PrintVerboseErr("PackageManager.AddMany", 5, err)
+		return err
+	}
+	for _, pkg := range pkgs {
+		err = p.recordChange(ADD, pkg)
+		if err != nil {
+			PrintVerboseErr("PackageManager.AddMany", 5.1, err)
+			return err
+		}
+	}
+
+	if removeChanged {
+		PrintVerboseInfo("PackageManager.AddMany", "unsetting manually removed packages")
+		err = p.writeRemovePackages(pkgsRemove)
+		if err != nil {
+			PrintVerboseErr("PackageManager.AddMany", 6, err)
+			return err
+		}
+	}
+	if addChanged {
+		PrintVerboseInfo("PackageManager.AddMany", "writing packages.add")
+		err = p.writeAddPackages(pkgsAdd)
+		if err != nil {
+			PrintVerboseErr("PackageManager.AddMany", 7, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RemoveMany works like calling Remove for each of the given packages, but
+// reads and writes the package files once and checks every package in the
+// repo only once. If any package fails the checks, the returned error names
+// it and no file is modified. The repo checks share a retry budget as in
+// AddMany
+func (p *PackageManager) RemoveMany(pkgs []string) error {
+	PrintVerboseInfo("PackageManager.RemoveMany", "running...")
+
+	err := p.CheckStatus()
+	if err != nil {
+		PrintVerboseErr("PackageManager.RemoveMany", 0, err)
+		return err
+	}
+
+	unpinned := []string{}
+	for _, pkg := range pkgs {
+		err = validatePackageName(pkg, false)
+		if err != nil {
+			PrintVerboseErr("PackageManager.RemoveMany", 0.05, err)
+			return err
+		}
+		unpinned = append(unpinned, packageKey(pkg))
+	}
+	pkgs = unpinned
+
+	toCheck := []string{}
+	for _, pkg := range pkgs {
+		if !slices.Contains(toCheck, pkg) {
+			toCheck = append(toCheck, pkg)
+		}
+	}
+	err = p.validateInRepo(withRetryBudget(context.Background()), toCheck...)
+	if err != nil {
+		PrintVerboseErr("PackageManager.RemoveMany", 1, err)
+		return err
+	}
+	p.setLastRemovalImpacts(p.removalImpacts(toCheck...))
+	// the repo checks above run before taking the lock, so that a slow repo
+	// does not hold back the other writers
+	unlock, err := p.lock()
+	if err != nil {
+		PrintVerboseErr("PackageManager.RemoveMany", 0.1, err)
+		return err
+	}
+	defer unlock()
+
+	err = p.checkInstalled(toCheck...)
+	if err != nil {
+		PrintVerboseErr("PackageManager.RemoveMany", 1.2, err)
+		return err
+	}
+
+	upkgs, err := p.GetUnstagedPackages()
+	if err != nil {
+		PrintVerboseErr("PackageManager.RemoveMany", 2, err)
+		return err
+	}
+	held, err := p.GetHeldPackages()
+	if err != nil {
+		PrintVerboseErr("PackageManager.RemoveMany", 3, err)
+		return err
+	}
+	pkgsAdd, err := p.GetAddPackages()
+	if err != nil {
+		PrintVerboseErr("PackageManager.RemoveMany", 4, err)
+		return err
+	}
+	pkgsRemove, err := p.GetRemovePackages()
+	if err != nil {
+		PrintVerboseErr("PackageManager.RemoveMany", 5, err)
+		return err
+	}
+
+	holdChanged, addChanged, removeChanged := false, false, false
+	for _, pkg := range pkgs {
+		p.trace("remove", pkg)
+		upkgs = append(upkgs, UnstagedPackage{pkg, REMOVE})
+
+		// a removed package cannot be held anymore
+		if i := slices.Index(held, pkg); i != -1 {
+			held = slices.Delete(held, i, i+1)
+			holdChanged = true
+		}
+
+		// a package added by the user is only dropped from packages.add
+		i := slices.IndexFunc(pkgsAdd, func(ap string) bool {
+			return packageKey(ap) == pkg
+		})
+		if i != -1 {
+			pkgsAdd = slices.Delete(pkgsAdd, i, i+1)
+			addChanged = true
+			continue
+		}
+
+		if !slices.Contains(pkgsRemove, pkg) {
+			pkgsRemove = append(pkgsRemove, pkg)
+			removeChanged = true
+		}
+	}
+
+	err = p.writeUnstagedPackages(upkgs)
+	if err != nil {
+		PrintVerboseErr("PackageManager.RemoveMany", 6, err)
+		return err
+	}
+	for _, pkg := range pkgs {
+		err = p.recordChange(REMOVE, pkg)
+		if err != nil {
+			PrintVerboseErr("PackageManager.RemoveMany", 6.1, err)
+			return err
+		}
+	}
+
+	if holdChanged {
+		err = p.writePackages(PackagesHoldFile, held)
+		if err != nil {
+			PrintVerboseErr("PackageManager.RemoveMany", 7, err)
+			return err
+		}
+	}
+	if addChanged {
+		PrintVerboseInfo("PackageManager.RemoveMany", "removing manually added packages")
+		err = p.writeAddPackages(pkgsAdd)
+		if err != nil {
+			PrintVerboseErr("PackageManager.RemoveMany", 8, err)
+			return err
+		}
+	}
+	if removeChanged {
+		PrintVerboseInfo("PackageManager.RemoveMany", "writing packages.remove")
+		err = p.writeRemovePackages(pkgsRemove)
+		if err != nil {
+			PrintVerboseErr("PackageManager.RemoveMany", 9, err)
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,242 @@
+package core
+
+/*	License: GPLv3
+	Authors:
+		Mirko Brombin <mirko@fabricators.ltd>
+		Vanilla OS Contributors <https://github.com/vanilla-os/>
+	Copyright: 2024
+	Description:
+		ABRoot is utility which provides full immutability and
+		atomicity to a Linux system, by transacting between
+		two root filesystems. Updates are performed using OCI
+		images, to ensure that the system is always in a
+		consistent state.
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/vanilla-os/abroot/settings"
+)
+
+// PackagesResumeFile holds the progress of a chunked apply, it exists only
+// while a chunked apply is in progress or was interrupted
+const PackagesResumeFile = "apply.resume"
+
+// ChunkRunner runs the command of a chunk of a chunked apply
+type ChunkRunner func(plan CommandPlan) error
+
+// applyResumeMarker is the content of the resume file
+type applyResumeMarker struct {
+	ChunkSize int `json:"chunkSize"`
+	Completed int `json:"completed"`
+}
+
+// ApplyChunked applies the unstaged changes in chunks of at most chunkSize
+// packages, running the command of each chunk with run. The packages of a
+// chunk are cleared from the unstaged ones as soon as it succeeds and the
+// progress is kept in the resume file, so that an interrupted apply can be
+// continued with ResumeApply. A chunk interrupted after its command ran but
+// before it was cleared is run again on resume
+func (p *PackageManager) ApplyChunked(chunkSize int, run ChunkRunner) error {
+	PrintVerboseInfo("PackageManager.ApplyChunked", "running...")
+
+	// Check for package manager status and user agreement
+	err := p.CheckStatus()
+	if err != nil {
+		PrintVerboseErr("PackageManager.ApplyChunked", 0, err)
+		return err
+	}
+
+	if chunkSize <= 0 {
+		err := fmt.Errorf("invalid chunk size %d, it must be positive", chunkSize)
+		PrintVerboseErr("PackageManager.ApplyChunked", 0.1, err)
+		return err
+	}
+
+	_, err = p.readResumeMarker()
+	if err == nil {
+		err = errors.New("an interrupted chunked apply is pending, continue it with ResumeApply")
+		PrintVerboseErr("PackageManager.ApplyChunked", 1, err)
+		return err
+	}
+
+	return p.applyChunks(&applyResumeMarker{ChunkSize: chunkSize}, run)
+}
+
+// ResumeApply continues an interrupted chunked apply from the last chunk
+// which succeeded
+func (p *PackageManager) ResumeApply(run ChunkRunner) error {
+	PrintVerboseInfo("PackageManager.ResumeApply", "running...")
+
+	// Check for package manager status and user agreement
+	err := p.CheckStatus()
+	if err != nil {
+		PrintVerboseErr("PackageManager.ResumeApply", 0, err)
+		return err
+	}
+
+	marker, err := p.readResumeMarker()
+	if errors.Is(err, os.ErrNotExist) {
+		err = errors.New("no interrupted chunked apply to resume")
+	}
+	if err != nil {
+		PrintVerboseErr("PackageManager.ResumeApply", 0.1, err)
+		return err
+	}
+
+	PrintVerboseInfo("PackageManager.ResumeApply", "resuming after", marker.Completed, "chunks")
+	return p.applyChunks(marker, run)
+}
+
+// applyChunks applies the unstaged changes chunk by chunk, updating the
+// resume marker after each of them and removing it once done
+func (p *PackageManager) applyChunks(marker *applyResumeMarker, run ChunkRunner) error {
+	err := p.writeResumeMarker(marker)
+	if err != nil {
+		PrintVerboseErr("PackageManager.applyChunks", 0, err)
+		return err
+	}
+
+	for {
+		upkgs, err := p.GetUnstagedPackages()
+		if err != nil {
+			PrintVerboseErr("PackageManager.applyChunks", 1, err)
+			return err
+		}
+		if len(upkgs) == 0 {
+			break
+		}
+
+		chunk := upkgs[:min(marker.ChunkSize, len(upkgs))]
+		plan, err := p.chunkPlan(chunk)
+		if err != nil {
+			PrintVerboseErr("PackageManager.applyChunks", 2, err)
+			return err
+		}
+
+		err = run(plan)
+		if err != nil {
+			PrintVerboseErr("PackageManager.applyChunks", 3, err)
+			return fmt.Errorf("chunk %d failed, the apply can be resumed: %w", marker.Completed+1, err)
+		}
+
+		err = p.clearAppliedPackages(chunk)
+		if err != nil {
+			PrintVerboseErr("PackageManager.applyChunks", 4, err)
+			return err
+		}
+
+		marker.Completed++
+		err = p.writeResumeMarker(marker)
+		if err != nil {
+			PrintVerboseErr("PackageManager.applyChunks", 5, err)
+			return err
+		}
+	}
+
+	return p.removeResumeMarker()
+}
+
+// chunkPlan builds the command plan of a chunk of unstaged changes
+func (p *PackageManager) chunkPlan(chunk []UnstagedPackage) (CommandPlan, error) {
+	var addPkgs, removePkgs []string
+	for _, pkg := range chunk {
+		switch pkg.Status {
+		case ADD:
+			addPkgs = append(addPkgs, pkg.Name)
+		case REMOVE:
+			removePkgs = append(removePkgs, pkg.Name)
+		}
+	}
+
+	if settings.Cnf.IPkgMngOrderByDeps {
+		addPkgs = p.orderByDeps(addPkgs)
+	}
+
+	cmd, err := p.builder().Build(APPLY, addPkgs, removePkgs)
+	if err != nil {
+		return CommandPlan{}, err
+	}
+
+	plan := CommandPlan{
+		Operation: APPLY,
+		Add:       packageNames(addPkgs),
+		Remove:    packageNames(removePkgs),
+		Cmd:       cmd,
+	}
+	if p.CommandPolicy != nil {
+		err = p.CommandPolicy(plan)
+		if err != nil {
+			return CommandPlan{}, fmt.Errorf("command vetoed by policy: %w", err)
+		}
+	}
+
+	return plan, nil
+}
+
+// clearAppliedPackages removes the given applied changes from the unstaged
+// packages, keeping the others
+func (p *PackageManager) clearAppliedPackages(applied []UnstagedPackage) error {
+	unlock, err := p.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	upkgs, err := p.GetUnstagedPackages()
+	if err != nil {
+		return err
+	}
+
+	kept := []UnstagedPackage{}
+	for _, upkg := range upkgs {
+		if !slices.Contains(applied, upkg) {
+			kept = append(kept, upkg)
+		}
+	}
+
+	return p.writeUnstagedPackages(kept)
+}
+
+func (p *PackageManager) readResumeMarker() (*applyResumeMarker, error) {
+	content, err := os.ReadFile(filepath.Join(p.baseDir, PackagesResumeFile))
+	if err != nil {
+		return nil, err
+	}
+
+	marker := &applyResumeMarker{}
+	err = json.Unmarshal(content, marker)
+	if err != nil {
+		return nil, err
+	}
+	if marker.ChunkSize <= 0 {
+		return nil, fmt.Errorf("invalid chunk size %d in %s", marker.ChunkSize, PackagesResumeFile)
+	}
+
+	return marker, nil
+}
+
+func (p *PackageManager) writeResumeMarker(marker *applyResumeMarker) error {
+	content, err := json.Marshal(marker)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(p.baseDir, PackagesResumeFile), content, packagesFileMode)
+}
+
+// removeResumeMarker removes the resume file, if any
+func (p *PackageManager) removeResumeMarker() error {
+	err := os.Remove(filepath.Join(p.baseDir, PackagesResumeFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,191 @@
+package core
+
+/*	License: GPLv3
+	Authors:
+		Mirko Brombin <mirko@fabricators.ltd>
+		Vanilla OS Contributors <https://github.com/vanilla-os/>
+	Copyright: 2024
+	Description:
+		ABRoot is utility which provides full immutability and
+		atomicity to a Linux system, by transacting between
+		two root filesystems. Updates are performed using OCI
+		images, to ensure that the system is always in a
+		consistent state.
+*/
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// PackageConflict is a package whose states across the package files
+// contradict each other, as reported by Validate
+type PackageConflict struct {
+	Package string
+	Reason  string
+}
+
+// ErrPackageConflicts is returned by Validate when some packages are in
+// contradictory states, which would produce a broken apply command
+type ErrPackageConflicts struct {
+	Conflicts []PackageConflict
+}
+
+func (e *ErrPackageConflicts) Error() string {
+	conflicts := []string{}
+	for _, conflict := range e.Conflicts {
+		conflicts = append(conflicts, fmt.Sprintf("%s (%s)", conflict.Package, conflict.Reason))
+	}
+
+	return fmt.Sprintf("conflicting package states: %s", strings.Join(conflicts, ", "))
+}
+
+// Validate checks the packages.add, packages.remove and packages.unstaged
+// files for packages in contradictory states, which Add and Remove never
+// produce but external edits can. It fails with an ErrPackageConflicts
+// listing them, see ResolveConflicts
+func (p *PackageManager) Validate() error {
+	PrintVerboseInfo("PackageManager.Validate", "running...")
+
+	conflicts, err := p.findConflicts()
+	if err != nil {
+		PrintVerboseErr("PackageManager.Validate", 0, err)
+		return err
+	}
+	if len(conflicts) > 0 {
+		err = &ErrPackageConflicts{conflicts}
+		PrintVerboseErr("PackageManager.Validate", 1, err)
+		return err
+	}
+
+	return nil
+}
+
+// ResolveConflicts removes the contradictions reported by Validate. The
+// unstaged change of a package wins over the package files: a package staged
+// for addition is dropped from packages.remove and a package staged for
+// removal is dropped from packages.add. Without an unstaged change, a package
+// listed in both files is dropped from packages.add, as a removal is the
+// latest decision Remove can leave in the files
+func (p *PackageManager) ResolveConflicts() error {
+	PrintVerboseInfo("PackageManager.ResolveConflicts", "running...")
+
+	unlock, err := p.lock()
+	if err != nil {
+		PrintVerboseErr("PackageManager.ResolveConflicts", 0, err)
+		return err
+	}
+	defer unlock()
+
+	pkgsAdd, pkgsRemove, upkgs, err := p.readPackageStates()
+	if err != nil {
+		PrintVerboseErr("PackageManager.ResolveConflicts", 1, err)
+		return err
+	}
+
+	staged := map[string]string{}
+	for _, upkg := range upkgs {
+		staged[upkg.Name] = upkg.Status
+	}
+
+	// blank lines are dropped along the way, the files are only rewritten
+	// if a package is unset though
+	keptRemove := []string{}
+	unsetRemove := false
+	for _, pkg := range pkgsRemove {
+		if pkg == "" {
+			continue
+		}
+		if staged[pkg] == ADD {
+			unsetRemove = true
+			PrintVerboseInfo("PackageManager.ResolveConflicts", "unsetting", pkg, "from packages.remove")
+			continue
+		}
+		keptRemove = append(keptRemove, pkg)
+	}
+
+	keptAdd := []string{}
+	unsetAdd := false
+	for _, pkg := range pkgsAdd {
+		name, _ := splitPackageOptions(pkg)
+		if name == "" {
+			continue
+		}
+		if staged[name] == REMOVE || (staged[name] == "" && slices.Contains(keptRemove, name)) {
+			PrintVerboseInfo("PackageManager.ResolveConflicts", "unsetting", name, "from packages.add")
+			unsetAdd = true
+			continue
+		}
+		keptAdd = append(keptAdd, pkg)
+	}
+
+	if unsetRemove {
+		err = p.writeRemovePackages(keptRemove)
+		if err != nil {
+			PrintVerboseErr("PackageManager.ResolveConflicts", 2, err)
+			return err
+		}
+	}
+	if unsetAdd {
+		err = p.writeAddPackages(keptAdd)
+		if err != nil {
+			PrintVerboseErr("PackageManager.ResolveConflicts", 3, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// findConflicts returns the packages in contradictory states, in the order
+// of packages.add followed by the ones only staged
+func (p *PackageManager) findConflicts() ([]PackageConflict, error) {
+	pkgsAdd, pkgsRemove, upkgs, err := p.readPackageStates()
+	if err != nil {
+		return nil, err
+	}
+
+	added := []string{}
+	conflicts := []PackageConflict{}
+	for _, pkg := range pkgsAdd {
+		name, _ := splitPackageOptions(pkg)
+		if name == "" {
+			continue
+		}
+		added = append(added, name)
+		if slices.Contains(pkgsRemove, name) {
+			conflicts = append(conflicts, PackageConflict{name, fmt.Sprintf("listed in both %s and %s", PackagesAddFile, PackagesRemoveFile)})
+		}
+	}
+
+	for _, upkg := range upkgs {
+		if upkg.Status == ADD && slices.Contains(pkgsRemove, upkg.Name) {
+			conflicts = append(conflicts, PackageConflict{upkg.Name, fmt.Sprintf("staged for addition while listed in %s", PackagesRemoveFile)})
+		}
+		if upkg.Status == REMOVE && slices.Contains(added, upkg.Name) {
+			conflicts = append(conflicts, PackageConflict{upkg.Name, fmt.Sprintf("staged for removal while listed in %s", PackagesAddFile)})
+		}
+	}
+
+	return conflicts, nil
+}
+
+// readPackageStates reads the packages.add, packages.remove and
+// packages.unstaged files
+func (p *PackageManager) readPackageStates() (pkgsAdd, pkgsRemove []string, upkgs []UnstagedPackage, err error) {
+	pkgsAdd, err = p.GetAddPackages()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	pkgsRemove, err = p.GetRemovePackages()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	upkgs, err = p.GetUnstagedPackages()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return pkgsAdd, pkgsRemove, upkgs, nil
+}
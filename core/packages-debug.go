@@ -0,0 +1,246 @@
+package core
+
+/*	License: GPLv3
+	Authors:
+		Mirko Brombin <mirko@fabricators.ltd>
+		Vanilla OS Contributors <https://github.com/vanilla-os/>
+	Copyright: 2024
+	Description:
+		ABRoot is utility which provides full immutability and
+		atomicity to a Linux system, by transacting between
+		two root filesystems. Updates are performed using OCI
+		images, to ensure that the system is always in a
+		consistent state.
+*/
+
+import (
+	"errors"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/vanilla-os/abroot/settings"
+)
+
+// redactedValue replaces the secrets found in a debug dump
+const redactedValue = "REDACTED"
+
+// DebugState is a snapshot of the package manager state meant to be attached
+// to bug reports, secrets are redacted
+type DebugState struct {
+	Config            DebugConfig       `json:"config"`
+	Files             map[string]string `json:"files"`
+	Counts            DebugCounts       `json:"counts"`
+	Status            int               `json:"status"`
+	AgreementAccepted bool              `json:"agreementAccepted"`
+	UnstagedProblems  []string          `json:"unstagedProblems"`
+	MissingBinaries   []string          `json:"missingBinaries"`
+}
+
+// DebugConfig is the package manager configuration, as found in a DebugState
+type DebugConfig struct {
+	Pre                string            `json:"iPkgMngPre"`
+	Post               string            `json:"iPkgMngPost"`
+	PreCmds            []string          `json:"iPkgMngPreCmds"`
+	PostCmds           []string          `json:"iPkgMngPostCmds"`
+	Add                string            `json:"iPkgMngAdd"`
+	Rm                 string            `json:"iPkgMngRm"`
+	Api                string            `json:"iPkgMngApi"`
+	ApiHeaders         map[string]string `json:"iPkgMngApiHeaders"`
+	Branch             string            `json:"iPkgMngBranch"`
+	Status             int               `json:"iPkgMngStatus"`
+	OkExitCodes        []int             `json:"iPkgMngOkExitCodes"`
+	AgreementVersion   int               `json:"iPkgMngAgreementVersion"`
+	ApplyUsesCommitted bool              `json:"iPkgMngApplyUsesCommitted"`
+}
+
+// DebugCounts are the package counts found in a DebugState
+type DebugCounts struct {
+	Added           int `json:"added"`
+	Removed         int `json:"removed"`
+	UnstagedAdds    int `json:"unstagedAdds"`
+	UnstagedRemoves int `json:"unstagedRemoves"`
+}
+
+// DebugDump collects the package manager configuration, the contents of the
+// package files, the package counts, the agreement status and the results of
+// the self checks into a single struct, which can be marshaled to JSON
+func (p *PackageManager) DebugDump() (DebugState, error) {
+	PrintVerboseInfo("PackageManager.DebugDump", "running...")
+
+	state := DebugState{
+		Config: DebugConfig{
+			Pre:                redactSecrets(settings.Cnf.IPkgMngPre),
+			Post:               redactSecrets(settings.Cnf.IPkgMngPost),
+			PreCmds:            []string{},
+			PostCmds:           []string{},
+			Add:                redactSecrets(settings.Cnf.IPkgMngAdd),
+			Rm:                 redactSecrets(settings.Cnf.IPkgMngRm),
+			Api:                redactURL(settings.Cnf.IPkgMngApi),
+			ApiHeaders:         map[string]string{},
+			Branch:             settings.Cnf.IPkgMngBranch,
+			Status:             settings.Cnf.IPkgMngStatus,
+			OkExitCodes:        p.OkExitCodes(),
+			AgreementVersion:   settings.Cnf.IPkgMngAgreementVersion,
+			ApplyUsesCommitted: settings.Cnf.IPkgMngApplyUsesCommitted,
+		},
+		Files:             map[string]string{},
+		Status:            int(p.Status),
+		AgreementAccepted: p.GetUserAgreementStatus(),
+		UnstagedProblems:  []string{},
+		MissingBinaries:   []string{},
+	}
+	for _, cmd := range settings.Cnf.IPkgMngPreCmds {
+		state.Config.PreCmds = append(state.Config.PreCmds, redactSecrets(cmd))
+	}
+	for _, cmd := range settings.Cnf.IPkgMngPostCmds {
+		state.Config.PostCmds = append(state.Config.PostCmds, redactSecrets(cmd))
+	}
+	// header values usually are credentials, only the names are kept
+	for name := range settings.Cnf.IPkgMngApiHeaders {
+		state.Config.ApiHeaders[name] = redactedValue
+	}
+
+	for _, file := range packageFiles {
+		contents, err := os.ReadFile(filepath.Join(p.baseDir, file))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			PrintVerboseErr("PackageManager.DebugDump", 0, err)
+			return DebugState{}, err
+		}
+		state.Files[file] = string(contents)
+	}
+
+	added, err := p.GetAddPackages()
+	if err != nil {
+		PrintVerboseErr("PackageManager.DebugDump", 1, err)
+		return DebugState{}, err
+	}
+	removed, err := p.GetRemovePackages()
+	if err != nil {
+		PrintVerboseErr("PackageManager.DebugDump", 2, err)
+		return DebugState{}, err
+	}
+	state.Counts.Added = countPackages(added)
+	state.Counts.Removed = countPackages(removed)
+
+	state.Counts.UnstagedAdds, state.Counts.UnstagedRemoves, err = p.UnstagedCounts()
+	if err != nil {
+		PrintVerboseErr("PackageManager.DebugDump", 3, err)
+		return DebugState{}, err
+	}
+
+	_, problems, err := p.InspectUnstaged()
+	if err != nil {
+		PrintVerboseErr("PackageManager.DebugDump", 4, err)
+		return DebugState{}, err
+	}
+	state.UnstagedProblems = append(state.UnstagedProblems, problems...)
+
+	for _, err := range p.CheckBinariesAvailable() {
+		state.MissingBinaries = append(state.MissingBinaries, err.Error())
+	}
+
+	return state, nil
+}
+
+// countPackages counts the non-empty entries of a package file
+func countPackages(pkgs []string) int {
+	count := 0
+	for _, pkg := range pkgs {
+		if strings.TrimSpace(pkg) != "" {
+			count++
+		}
+	}
+
+	return count
+}
+
+// redactURL hides the credentials and the query values of the given URL,
+// the URL is returned as is if it cannot be parsed
+func redactURL(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || parsed.Host == "" {
+		return rawURL
+	}
+
+	if parsed.User != nil {
+		parsed.User = url.User(redactedValue)
+	}
+
+	query := parsed.Query()
+	for key := range query {
+		query.Set(key, redactedValue)
+	}
+	parsed.RawQuery = query.Encode()
+
+	// keep the placeholders readable
+	return strings.NewReplacer("%7B", "{", "%7D", "}").Replace(parsed.String())
+}
+
+// redactSecrets redacts the URLs found in a command
+func redactSecrets(cmd string) string {
+	fields := strings.Fields(cmd)
+	for i, field := range fields {
+		if strings.Contains(field, "://") {
+			fields[i] = redactURL(field)
+		}
+	}
+
+	return strings.Join(fields, " ")
+}
+
+// Config provenances reported by ConfigProvenance
+const (
+	ProvenanceSettings   = "settings"
+	ProvenanceEnv        = "env"
+	ProvenanceStatusFile = "statusfile"
+	ProvenanceDefault    = "default"
+	ProvenanceRuntime    = "runtime"
+)
+
+// ConfigProvenance returns where the effective value of each package manager
+// setting comes from, as reported by settings.Source: "env" for the
+// environment variables of settings.EnvKeys, "settings" for the
+// configuration file and "default" for the built-in defaults. It also
+// reports the agreement status, the only value coming from a status file,
+// which comes from the admin policy ("settings"), the user agreement file
+// ("statusfile") or the default, and the actor recorded in the change
+// history, which comes from SUDO_USER ("env"), SetActor ("runtime") or
+// defaults to the current user
+func (p *PackageManager) ConfigProvenance() map[string]string {
+	PrintVerboseInfo("PackageManager.ConfigProvenance", "running...")
+
+	provenance := map[string]string{}
+	config := reflect.TypeOf(settings.Config{})
+	for i := 0; i < config.NumField(); i++ {
+		key := config.Field(i).Tag.Get("json")
+		if strings.HasPrefix(key, "iPkgMng") {
+			provenance[key] = settings.Source(key)
+		}
+	}
+
+	provenance["agreement"] = ProvenanceDefault
+	policy, err := readAgreementPolicy()
+	if err == nil && policy != nil {
+		provenance["agreement"] = ProvenanceSettings
+	} else if _, err := p.readUserAgreement(); err == nil {
+		provenance["agreement"] = ProvenanceStatusFile
+	}
+
+	switch {
+	case p.actor != "":
+		provenance["actor"] = ProvenanceRuntime
+	case os.Getenv("SUDO_USER") != "":
+		provenance["actor"] = ProvenanceEnv
+	default:
+		provenance["actor"] = ProvenanceDefault
+	}
+
+	return provenance
+}
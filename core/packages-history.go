@@ -0,0 +1,234 @@
+package core
+
+/*	License: GPLv3
+	Authors:
+		Mirko Brombin <mirko@fabricators.ltd>
+		Vanilla OS Contributors <https://github.com/vanilla-os/>
+	Copyright: 2024
+	Description:
+		ABRoot is utility which provides full immutability and
+		atomicity to a Linux system, by transacting between
+		two root filesystems. Updates are performed using OCI
+		images, to ensure that the system is always in a
+		consistent state.
+*/
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CLEAR is the operation of the change records written when the unstaged
+// packages are cleared, such records have no package
+const CLEAR = "clear"
+
+// PackagesHistoryMaxSize is the size the packages.history file can reach
+// before being rotated to packages.history.1, replacing the previous one
+const PackagesHistoryMaxSize = 1 << 20
+
+// ChangeRecord is a package change staged by Add or Remove, or the clearing
+// of the unstaged packages, as stored in the packages.history file
+type ChangeRecord struct {
+	Time      time.Time `json:"time"`
+	Operation string    `json:"operation"`
+	Package   string    `json:"package"`
+	Actor     string    `json:"actor"`
+}
+
+// HistoryEntry is an entry of the transaction history returned by GetHistory
+type HistoryEntry = ChangeRecord
+
+// SetActor sets who is staging the next changes, as recorded in the change
+// history. An empty actor resets it to the current user
+func (p *PackageManager) SetActor(actor string) {
+	p.actor = actor
+}
+
+// currentActor returns the actor of the next changes, which defaults to the
+// user who invoked sudo, if any, or to the current user
+func (p *PackageManager) currentActor() string {
+	if p.actor != "" {
+		return p.actor
+	}
+
+	if sudoUser := os.Getenv("SUDO_USER"); sudoUser != "" {
+		return sudoUser
+	}
+
+	u, err := user.Current()
+	if err != nil {
+		PrintVerboseWarn("PackageManager.currentActor", 0, err)
+		return "unknown"
+	}
+
+	return u.Username
+}
+
+// recordChange appends a change to the packages.history file
+func (p *PackageManager) recordChange(operation, pkg string) error {
+	record := ChangeRecord{
+		Time:      time.Now(),
+		Operation: operation,
+		Package:   pkg,
+		Actor:     p.currentActor(),
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	err = p.rotateHistory()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(
+		filepath.Join(p.baseDir, PackagesHistoryFile),
+		os.O_APPEND|os.O_CREATE|os.O_WRONLY,
+		0o644,
+	)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+// rotateHistory moves the packages.history file to packages.history.1 once
+// it reaches PackagesHistoryMaxSize, so that the history stays bounded
+func (p *PackageManager) rotateHistory() error {
+	path := filepath.Join(p.baseDir, PackagesHistoryFile)
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Size() < PackagesHistoryMaxSize {
+		return nil
+	}
+
+	PrintVerboseInfo("PackageManager.rotateHistory", "rotating", PackagesHistoryFile)
+	return os.Rename(path, filepath.Join(p.baseDir, PackagesHistoryRotatedFile))
+}
+
+// GetChangeHistory returns the package changes staged so far, oldest first,
+// the ones of the rotated history included
+func (p *PackageManager) GetChangeHistory() ([]ChangeRecord, error) {
+	PrintVerboseInfo("PackageManager.GetChangeHistory", "running...")
+
+	records := []ChangeRecord{}
+	for _, file := range []string{PackagesHistoryRotatedFile, PackagesHistoryFile} {
+		fileRecords, err := p.readHistory(file)
+		if err != nil {
+			PrintVerboseErr("PackageManager.GetChangeHistory", 0, err)
+			return nil, err
+		}
+		records = append(records, fileRecords...)
+	}
+
+	return records, nil
+}
+
+// GetHistory returns the transaction history of the package operations,
+// oldest first. It is the same as GetChangeHistory
+func (p *PackageManager) GetHistory() ([]HistoryEntry, error) {
+	PrintVerboseInfo("PackageManager.GetHistory", "running...")
+	return p.GetChangeHistory()
+}
+
+// readHistory reads the change records of a history file, a missing file
+// has no records
+func (p *PackageManager) readHistory(file string) ([]ChangeRecord, error) {
+	records := []ChangeRecord{}
+	f, err := os.Open(filepath.Join(p.baseDir, file))
+	if errors.Is(err, os.ErrNotExist) {
+		return records, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		record := ChangeRecord{}
+		err = json.Unmarshal([]byte(line), &record)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		records = append(records, record)
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+// TimelineEntry is a pending package change along with the time it was
+// staged, as returned by UnstagedTimeline
+type TimelineEntry struct {
+	Time      time.Time
+	Operation string
+	Package   string
+}
+
+// UnstagedTimeline returns the pending package changes with the time they
+// were staged, newest first. Times are taken from the change history, changes
+// missing from it have a zero time and are listed last
+func (p *PackageManager) UnstagedTimeline() ([]TimelineEntry, error) {
+	PrintVerboseInfo("PackageManager.UnstagedTimeline", "running...")
+
+	upkgs, err := p.GetUnstagedPackages()
+	if err != nil {
+		PrintVerboseErr("PackageManager.UnstagedTimeline", 0, err)
+		return nil, err
+	}
+
+	history, err := p.GetChangeHistory()
+	if err != nil {
+		PrintVerboseErr("PackageManager.UnstagedTimeline", 1, err)
+		return nil, err
+	}
+
+	timeline := []TimelineEntry{}
+	for _, upkg := range upkgs {
+		entry := TimelineEntry{Operation: upkg.Status, Package: upkg.Name}
+
+		// the latest matching record is the one which staged the change
+		for i := len(history) - 1; i >= 0; i-- {
+			if history[i].Package == upkg.Name && history[i].Operation == upkg.Status {
+				entry.Time = history[i].Time
+				break
+			}
+		}
+
+		timeline = append(timeline, entry)
+	}
+
+	sort.SliceStable(timeline, func(i, j int) bool {
+		return timeline[i].Time.After(timeline[j].Time)
+	})
+
+	return timeline, nil
+}
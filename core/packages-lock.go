@@ -0,0 +1,215 @@
+package core
+
+/*	License: GPLv3
+	Authors:
+		Mirko Brombin <mirko@fabricators.ltd>
+		Vanilla OS Contributors <https://github.com/vanilla-os/>
+	Copyright: 2024
+	Description:
+		ABRoot is utility which provides full immutability and
+		atomicity to a Linux system, by transacting between
+		two root filesystems. Updates are performed using OCI
+		images, to ensure that the system is always in a
+		consistent state.
+*/
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// PackagesLockFile is the file locked while the package files are being
+// modified, so that concurrent processes do not overwrite each other's
+// changes
+const PackagesLockFile = "packages.lock"
+
+// DefaultLockTimeout is how long a package manager waits for the lock
+// before giving up, unless changed with SetLockTimeout
+const DefaultLockTimeout = 30 * time.Second
+
+// lockRetryInterval is how often a busy lock is tried again
+const lockRetryInterval = 10 * time.Millisecond
+
+// ErrLockTimeout is returned when the package files lock could not be
+// acquired within the lock timeout
+var ErrLockTimeout = errors.New("timed out waiting for the package files lock")
+
+// SetLockTimeout sets how long the package manager waits for the package
+// files lock held by another process
+func (p *PackageManager) SetLockTimeout(timeout time.Duration) {
+	p.lockTimeout = timeout
+}
+
+// lock acquires the package files lock, waiting up to the lock timeout, and
+// returns the function releasing it. Goroutines of the same process are
+// serialized by the package manager mutex first, so they neither poll the
+// file lock nor race on the in-memory state updated along the files
+func (p *PackageManager) lock() (func(), error) {
+	return p.lockCtx(context.Background())
+}
+
+// lockCtx works like lock but gives up waiting once the given context is
+// cancelled, returning its error
+func (p *PackageManager) lockCtx(ctx context.Context) (func(), error) {
+	err := p.lockMutex(ctx)
+	if err != nil {
+		PrintVerboseErr("PackageManager.lock", 0.5, err)
+		return nil, err
+	}
+
+	path := filepath.Join(p.baseDir, PackagesLockFile)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, packagesFileMode)
+	if err != nil {
+		p.mutex.Unlock()
+		PrintVerboseErr("PackageManager.lock", 0, err)
+		return nil, err
+	}
+
+	deadline := time.Now().Add(p.lockTimeout)
+	for {
+		err = unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, unix.EWOULDBLOCK) {
+			f.Close()
+			p.mutex.Unlock()
+			PrintVerboseErr("PackageManager.lock", 1, err)
+			return nil, err
+		}
+		if time.Now().After(deadline) {
+			f.Close()
+			p.mutex.Unlock()
+			err = fmt.Errorf("%w: %s", ErrLockTimeout, path)
+			PrintVerboseErr("PackageManager.lock", 2, err)
+			return nil, err
+		}
+
+		select {
+		case <-time.After(lockRetryInterval):
+		case <-ctx.Done():
+			f.Close()
+			p.mutex.Unlock()
+			PrintVerboseErr("PackageManager.lock", 3, ctx.Err())
+			return nil, ctx.Err()
+		}
+	}
+
+	return func() {
+		unix.Flock(int(f.Fd()), unix.LOCK_UN)
+		f.Close()
+		p.mutex.Unlock()
+	}, nil
+}
+
+// lockMutex locks the package manager mutex, giving up once the given
+// context is cancelled. A mutex acquired after giving up is released right
+// away
+func (p *PackageManager) lockMutex(ctx context.Context) error {
+	if ctx.Done() == nil {
+		p.mutex.Lock()
+		return nil
+	}
+
+	acquired := make(chan struct{})
+	go func() {
+		p.mutex.Lock()
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		return nil
+	case <-ctx.Done():
+		go func() {
+			<-acquired
+			p.mutex.Unlock()
+		}()
+		return ctx.Err()
+	}
+}
+
+// lockForAdd runs the repo and license checks of the packages to add, then
+// acquires the package files lock and returns the function releasing it.
+// The checks run before the lock so that a slow repo does not hold back the
+// other writers. Which packages are checked depends on the package files, so
+// it is worked out again under the lock, and the lock is released to check
+// the packages the files changed in between require
+func (p *PackageManager) lockForAdd(ctx context.Context, pkgs ...string) (func(), error) {
+	checked := []string{}
+	violations := []LicenseViolation{}
+	var unlock func()
+	for {
+		toCheck, err := p.addRepoChecks(pkgs, checked)
+		if err != nil {
+			if unlock != nil {
+				unlock()
+			}
+			return nil, err
+		}
+		if unlock != nil {
+			if len(toCheck) == 0 {
+				break
+			}
+			unlock()
+		}
+
+		err = p.validateInRepo(ctx, toCheck...)
+		if err != nil {
+			return nil, err
+		}
+		found, err := p.checkLicenses(ctx, toCheck...)
+		if err != nil {
+			p.setLastLicenseViolations([]LicenseViolation{})
+			return nil, err
+		}
+		checked = append(checked, toCheck...)
+		violations = append(violations, found...)
+
+		unlock, err = p.lockCtx(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	p.setLastLicenseViolations(violations)
+	return unlock, nil
+}
+
+// addRepoChecks returns the packages to add which need the repo checks,
+// those in checked aside. Packages that have been removed by the user aren't
+// always in the repo, while pending removals have already been checked by
+// Remove, so neither is checked
+func (p *PackageManager) addRepoChecks(pkgs []string, checked []string) ([]string, error) {
+	pkgsRemove, err := p.GetRemovePackages()
+	if err != nil {
+		return nil, err
+	}
+	upkgs, err := p.GetUnstagedPackages()
+	if err != nil {
+		return nil, err
+	}
+
+	toCheck := []string{}
+	for _, pkg := range pkgs {
+		pkgName := packageKey(pkg)
+		if slices.Contains(pkgsRemove, pkgName) || slices.Contains(upkgs, UnstagedPackage{pkgName, REMOVE}) {
+			continue
+		}
+		for _, name := range strings.Fields(pkgName) {
+			if !slices.Contains(checked, name) && !slices.Contains(toCheck, name) {
+				toCheck = append(toCheck, name)
+			}
+		}
+	}
+
+	return toCheck, nil
+}
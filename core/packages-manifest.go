@@ -0,0 +1,156 @@
+package core
+
+/*	License: GPLv3
+	Authors:
+		Mirko Brombin <mirko@fabricators.ltd>
+		Vanilla OS Contributors <https://github.com/vanilla-os/>
+	Copyright: 2024
+	Description:
+		ABRoot is utility which provides full immutability and
+		atomicity to a Linux system, by transacting between
+		two root filesystems. Updates are performed using OCI
+		images, to ensure that the system is always in a
+		consistent state.
+*/
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// PackageManifestVersion is the version of the manifest format written by
+// ExportManifest
+const PackageManifestVersion = 1
+
+// PackageManifest pins the added packages to a version and records their
+// checksum, as reported by the repository API. Packages are sorted by name
+// so that the same package set always gives the same manifest, which can
+// then be signed
+type PackageManifest struct {
+	Version  int             `json:"version"`
+	Packages []ManifestEntry `json:"packages"`
+}
+
+// ManifestEntry is a package pinned by a PackageManifest
+type ManifestEntry struct {
+	Name     string `json:"name"`
+	Version  string `json:"version"`
+	Checksum string `json:"checksum"`
+}
+
+// ErrUnresolvedPackages is returned when the repository API cannot provide
+// the version or checksum of some packages of a manifest
+type ErrUnresolvedPackages struct {
+	Packages []string
+}
+
+func (e *ErrUnresolvedPackages) Error() string {
+	return fmt.Sprintf("cannot resolve the version and checksum of: %s", strings.Join(e.Packages, ", "))
+}
+
+// ExportManifest builds a PackageManifest pinning every added package to
+// the version and checksum reported by the repository API. It fails with an
+// ErrUnresolvedPackages listing the packages the API cannot resolve
+func (p *PackageManager) ExportManifest() (PackageManifest, error) {
+	PrintVerboseInfo("PackageManager.ExportManifest", "running...")
+
+	pkgs, err := p.GetAddPackages()
+	if err != nil {
+		PrintVerboseErr("PackageManager.ExportManifest", 0, err)
+		return PackageManifest{}, err
+	}
+
+	manifest := PackageManifest{Version: PackageManifestVersion, Packages: []ManifestEntry{}}
+	unresolved := []string{}
+	for _, name := range packageNames(pkgs) {
+		pkgInfo, err := p.GetPackageInfo(name)
+		if err != nil || pkgInfo.Version == "" || pkgInfo.Checksum == "" {
+			unresolved = append(unresolved, name)
+			continue
+		}
+
+		manifest.Packages = append(manifest.Packages, ManifestEntry{name, pkgInfo.Version, pkgInfo.Checksum})
+	}
+
+	if len(unresolved) > 0 {
+		err = &ErrUnresolvedPackages{unresolved}
+		PrintVerboseErr("PackageManager.ExportManifest", 1, err)
+		return PackageManifest{}, err
+	}
+
+	sort.Slice(manifest.Packages, func(i, j int) bool {
+		return manifest.Packages[i].Name < manifest.Packages[j].Name
+	})
+
+	return manifest, nil
+}
+
+// ErrChecksumMismatch is returned by ApplyManifest when the repository API
+// reports another checksum than the manifest for a package
+type ErrChecksumMismatch struct {
+	Package  string
+	Expected string
+	Actual   string
+}
+
+func (e *ErrChecksumMismatch) Error() string {
+	return fmt.Sprintf("checksum mismatch for %s: the manifest pins %s but the repo reports %s", e.Package, e.Expected, e.Actual)
+}
+
+// ApplyManifest replaces the added packages with the ones pinned by the
+// manifest, as name=version entries, staging the differences as
+// ReplaceAddPackages does: a package pinned to another version is staged as
+// a single addition of the new pin. Every entry must have a version and a
+// checksum, which is verified against the repository API before anything is
+// staged
+func (p *PackageManager) ApplyManifest(manifest PackageManifest) error {
+	PrintVerboseInfo("PackageManager.ApplyManifest", "running...")
+
+	if manifest.Version > PackageManifestVersion {
+		err := fmt.Errorf("unsupported manifest version %d, the newest supported one is %d", manifest.Version, PackageManifestVersion)
+		PrintVerboseErr("PackageManager.ApplyManifest", 0, err)
+		return err
+	}
+
+	names := []string{}
+	pins := []string{}
+	for _, entry := range manifest.Packages {
+		if entry.Version == "" || entry.Checksum == "" {
+			err := fmt.Errorf("manifest entry %s has no version or checksum", entry.Name)
+			PrintVerboseErr("PackageManager.ApplyManifest", 0.1, err)
+			return err
+		}
+		pin := fmt.Sprintf("%s=%s", entry.Name, entry.Version)
+		err := validatePackageName(pin, false)
+		if err != nil {
+			PrintVerboseErr("PackageManager.ApplyManifest", 0.2, err)
+			return err
+		}
+
+		names = append(names, entry.Name)
+		pins = append(pins, pin)
+	}
+
+	for _, entry := range manifest.Packages {
+		pkgInfo, err := p.GetPackageInfo(entry.Name)
+		if err != nil {
+			PrintVerboseErr("PackageManager.ApplyManifest", 0.3, err)
+			return fmt.Errorf("cannot verify the checksum of %s: %w", entry.Name, err)
+		}
+		if pkgInfo.Checksum != entry.Checksum {
+			err = &ErrChecksumMismatch{entry.Name, entry.Checksum, pkgInfo.Checksum}
+			PrintVerboseErr("PackageManager.ApplyManifest", 0.4, err)
+			return err
+		}
+	}
+
+	err := p.validateInRepo(withRetryBudget(context.Background()), names...)
+	if err != nil {
+		PrintVerboseErr("PackageManager.ApplyManifest", 1, err)
+		return err
+	}
+
+	return p.replaceAddPackages(pins, false)
+}
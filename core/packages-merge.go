@@ -0,0 +1,221 @@
+package core
+
+/*	License: GPLv3
+	Authors:
+		Mirko Brombin <mirko@fabricators.ltd>
+		Vanilla OS Contributors <https://github.com/vanilla-os/>
+	Copyright: 2024
+	Description:
+		ABRoot is utility which provides full immutability and
+		atomicity to a Linux system, by transacting between
+		two root filesystems. Updates are performed using OCI
+		images, to ensure that the system is always in a
+		consistent state.
+*/
+
+import (
+	"fmt"
+	"slices"
+)
+
+// MergePolicy decides how Merge resolves a package which is added by one
+// package manager and removed by the other
+type MergePolicy int
+
+// Merge policies
+const (
+	// MergeFail aborts the merge without changing any file
+	MergeFail MergePolicy = iota
+	// MergePreferThis keeps the state of the package manager merged into
+	MergePreferThis
+	// MergePreferOther takes the state of the package manager being merged
+	MergePreferOther
+)
+
+// Conflict is a package which is added by one package manager and removed
+// by the other, as reported by Merge. This and Other are the operations of
+// each package manager, Resolution is the one kept, empty if none was
+type Conflict struct {
+	Package    string
+	This       string
+	Other      string
+	Resolution string
+}
+
+// Merge combines the added, removed and held packages of another package
+// manager into this one. The changes to the added and removed packages are
+// staged, so that they are part of the next apply. Conflicting packages are
+// resolved according to the policy and reported; with MergeFail, no file is
+// changed and an error is returned if there is any conflict. Packages are
+// matched by name, a package added by both with another version pin or other
+// options takes the entry of the other package manager, unless the policy is
+// MergePreferThis
+func (p *PackageManager) Merge(other *PackageManager, policy MergePolicy) ([]Conflict, error) {
+	PrintVerboseInfo("PackageManager.Merge", "running...")
+
+	err := p.CheckStatus()
+	if err != nil {
+		PrintVerboseErr("PackageManager.Merge", 0, err)
+		return nil, err
+	}
+
+	unlock, err := p.lock()
+	if err != nil {
+		PrintVerboseErr("PackageManager.Merge", 0.5, err)
+		return nil, err
+	}
+	defer unlock()
+
+	thisAdd, thisRemove, thisHold, err := p.mergeSets()
+	if err != nil {
+		PrintVerboseErr("PackageManager.Merge", 1, err)
+		return nil, err
+	}
+	otherAdd, otherRemove, otherHold, err := other.mergeSets()
+	if err != nil {
+		PrintVerboseErr("PackageManager.Merge", 2, err)
+		return nil, err
+	}
+
+	// the entries of the other package manager are copied as they are, so
+	// they get the checks of the writers which would have added them
+	for _, pkg := range otherAdd {
+		err = validatePackageName(pkg, true)
+		if err != nil {
+			PrintVerboseErr("PackageManager.Merge", 2.1, err)
+			return nil, err
+		}
+	}
+	for _, pkg := range slices.Concat(otherRemove, otherHold) {
+		err = validatePackageName(pkg, false)
+		if err != nil {
+			PrintVerboseErr("PackageManager.Merge", 2.2, err)
+			return nil, err
+		}
+	}
+
+	// entries are matched by package, so that a version pin or install
+	// options never hide a conflict
+	conflicts := []Conflict{}
+	newAdd := slices.Clone(thisAdd)
+	newRemove := slices.Clone(thisRemove)
+
+	for _, pkg := range otherAdd {
+		key := packageKey(pkg)
+		switch i := indexPackageKey(newAdd, key); {
+		case indexPackageKey(thisRemove, key) >= 0:
+			conflict := Conflict{key, REMOVE, ADD, ""}
+			if policy == MergePreferOther {
+				conflict.Resolution = ADD
+				newRemove = slices.DeleteFunc(newRemove, func(s string) bool { return packageKey(s) == key })
+				newAdd = append(newAdd, pkg)
+			} else if policy == MergePreferThis {
+				conflict.Resolution = REMOVE
+			}
+			conflicts = append(conflicts, conflict)
+		case i < 0:
+			newAdd = append(newAdd, pkg)
+		case newAdd[i] != pkg && policy != MergePreferThis:
+			// another pin of the package replaces this one, as in Add
+			newAdd[i] = pkg
+		}
+	}
+
+	for _, pkg := range otherRemove {
+		key := packageKey(pkg)
+		switch {
+		case indexPackageKey(thisAdd, key) >= 0:
+			conflict := Conflict{key, ADD, REMOVE, ""}
+			if policy == MergePreferOther {
+				conflict.Resolution = REMOVE
+				newAdd = slices.DeleteFunc(newAdd, func(s string) bool { return packageKey(s) == key })
+				newRemove = append(newRemove, pkg)
+			} else if policy == MergePreferThis {
+				conflict.Resolution = ADD
+			}
+			conflicts = append(conflicts, conflict)
+		case indexPackageKey(newRemove, key) < 0:
+			newRemove = append(newRemove, pkg)
+		}
+	}
+
+	if policy == MergeFail && len(conflicts) > 0 {
+		err = fmt.Errorf("merge aborted, %d conflicting packages", len(conflicts))
+		PrintVerboseErr("PackageManager.Merge", 3, err)
+		return conflicts, err
+	}
+
+	upkgs, err := p.GetUnstagedPackages()
+	if err != nil {
+		PrintVerboseErr("PackageManager.Merge", 4, err)
+		return nil, err
+	}
+	for _, pkg := range newAdd {
+		if !slices.Contains(thisAdd, pkg) {
+			upkgs = append(upkgs, UnstagedPackage{pkg, ADD})
+		}
+	}
+	for _, pkg := range newRemove {
+		if !slices.Contains(thisRemove, pkg) {
+			upkgs = append(upkgs, UnstagedPackage{pkg, REMOVE})
+		}
+	}
+
+	newHold := slices.Clone(thisHold)
+	for _, pkg := range otherHold {
+		if indexPackageKey(newHold, packageKey(pkg)) < 0 {
+			newHold = append(newHold, pkg)
+		}
+	}
+
+	err = p.writeUnstagedPackages(upkgs)
+	if err != nil {
+		PrintVerboseErr("PackageManager.Merge", 5, err)
+		return nil, err
+	}
+	err = p.writeAddPackages(newAdd)
+	if err != nil {
+		PrintVerboseErr("PackageManager.Merge", 6, err)
+		return nil, err
+	}
+	err = p.writeRemovePackages(newRemove)
+	if err != nil {
+		PrintVerboseErr("PackageManager.Merge", 7, err)
+		return nil, err
+	}
+	if len(newHold) != len(thisHold) {
+		err = p.writePackages(PackagesHoldFile, newHold)
+		if err != nil {
+			PrintVerboseErr("PackageManager.Merge", 8, err)
+			return nil, err
+		}
+	}
+
+	return conflicts, nil
+}
+
+// indexPackageKey returns the index of the entry of the given package, see
+// packageKey, or -1 if there is none
+func indexPackageKey(pkgs []string, key string) int {
+	return slices.IndexFunc(pkgs, func(s string) bool { return packageKey(s) == key })
+}
+
+// mergeSets returns the non-empty entries of the added, removed and held
+// packages
+func (p *PackageManager) mergeSets() (add []string, remove []string, hold []string, err error) {
+	add, err = p.GetAddPackages()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	remove, err = p.GetRemovePackages()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	hold, err = p.GetHeldPackages()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	isEmpty := func(s string) bool { return s == "" }
+	return slices.DeleteFunc(add, isEmpty), slices.DeleteFunc(remove, isEmpty), hold, nil
+}
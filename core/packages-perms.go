@@ -0,0 +1,120 @@
+package core
+
+/*	License: GPLv3
+	Authors:
+		Mirko Brombin <mirko@fabricators.ltd>
+		Vanilla OS Contributors <https://github.com/vanilla-os/>
+	Copyright: 2024
+	Description:
+		ABRoot is utility which provides full immutability and
+		atomicity to a Linux system, by transacting between
+		two root filesystems. Updates are performed using OCI
+		images, to ensure that the system is always in a
+		consistent state.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Expected modes of the package manager base directory and files
+const (
+	packagesDirMode  fs.FileMode = 0o755
+	packagesFileMode fs.FileMode = 0o644
+)
+
+// permissionTarget is a path whose mode is checked by CheckPermissions
+type permissionTarget struct {
+	path string
+	mode fs.FileMode
+}
+
+// permissionTargets returns the existing package manager paths along with
+// the mode each should have
+func (p *PackageManager) permissionTargets() ([]permissionTarget, error) {
+	targets := []permissionTarget{{p.baseDir, packagesDirMode}}
+
+	files := append([]string{}, packageFiles...)
+	files = append(files, filepath.Base(p.userAgreementFile()))
+	for _, file := range files {
+		path := filepath.Join(p.baseDir, file)
+		_, err := os.Stat(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, permissionTarget{path, packagesFileMode})
+	}
+
+	return targets, nil
+}
+
+// CheckPermissions verifies that the package manager base directory has mode
+// 0755 and its files, the user agreement included, have mode 0644. An error
+// is returned for every deviation
+func (p *PackageManager) CheckPermissions() []error {
+	PrintVerboseInfo("PackageManager.CheckPermissions", "running...")
+
+	targets, err := p.permissionTargets()
+	if err != nil {
+		PrintVerboseErr("PackageManager.CheckPermissions", 0, err)
+		return []error{err}
+	}
+
+	errs := []error{}
+	for _, target := range targets {
+		info, err := os.Stat(target.path)
+		if err != nil {
+			PrintVerboseErr("PackageManager.CheckPermissions", 1, err)
+			errs = append(errs, err)
+			continue
+		}
+
+		if info.Mode().Perm() != target.mode {
+			err = fmt.Errorf("%s has mode %#o, expected %#o", target.path, info.Mode().Perm(), target.mode)
+			PrintVerboseWarn("PackageManager.CheckPermissions", 2, err)
+			errs = append(errs, err)
+		}
+	}
+
+	return errs
+}
+
+// FixPermissions sets the expected modes on the package manager base
+// directory and files, see CheckPermissions
+func (p *PackageManager) FixPermissions() error {
+	PrintVerboseInfo("PackageManager.FixPermissions", "running...")
+
+	targets, err := p.permissionTargets()
+	if err != nil {
+		PrintVerboseErr("PackageManager.FixPermissions", 0, err)
+		return err
+	}
+
+	errs := []error{}
+	for _, target := range targets {
+		info, err := os.Stat(target.path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if info.Mode().Perm() == target.mode {
+			continue
+		}
+
+		PrintVerboseInfo("PackageManager.FixPermissions", "fixing the mode of "+target.path)
+		err = os.Chmod(target.path, target.mode)
+		if err != nil {
+			PrintVerboseErr("PackageManager.FixPermissions", 1, err)
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,73 @@
+package core
+
+/*	License: GPLv3
+	Authors:
+		Mirko Brombin <mirko@fabricators.ltd>
+		Vanilla OS Contributors <https://github.com/vanilla-os/>
+	Copyright: 2024
+	Description:
+		ABRoot is utility which provides full immutability and
+		atomicity to a Linux system, by transacting between
+		two root filesystems. Updates are performed using OCI
+		images, to ensure that the system is always in a
+		consistent state.
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/vanilla-os/abroot/settings"
+)
+
+const (
+	// AgreementPolicyAccepted makes the policy accept the agreement on
+	// behalf of the user
+	AgreementPolicyAccepted = "accepted"
+
+	// AgreementPolicyRequired makes the policy require the user to accept
+	// the agreement, after RequiredSince if set
+	AgreementPolicyRequired = "required"
+)
+
+// AgreementPolicy is the content of the admin policy file set by
+// IPkgMngAgreementPolicyFile, which overrides the local agreement decision.
+// It lets management tools pre-accept the agreement or force the users to
+// accept it again: with the required policy, agreements accepted before
+// RequiredSince are not considered accepted
+type AgreementPolicy struct {
+	Agreement     string    `json:"agreement"`
+	RequiredSince time.Time `json:"requiredSince"`
+}
+
+// readAgreementPolicy reads the admin agreement policy, it returns nil if no
+// policy is set or the policy file does not exist
+func readAgreementPolicy() (*AgreementPolicy, error) {
+	if settings.Cnf.IPkgMngAgreementPolicyFile == "" {
+		return nil, nil
+	}
+
+	content, err := os.ReadFile(settings.Cnf.IPkgMngAgreementPolicyFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	policy := &AgreementPolicy{}
+	err = json.Unmarshal(content, policy)
+	if err != nil {
+		return nil, err
+	}
+
+	switch policy.Agreement {
+	case AgreementPolicyAccepted, AgreementPolicyRequired:
+		return policy, nil
+	default:
+		return nil, fmt.Errorf("unknown agreement policy %q in %s", policy.Agreement, settings.Cnf.IPkgMngAgreementPolicyFile)
+	}
+}
@@ -0,0 +1,672 @@
+package core
+
+/*	License: GPLv3
+	Authors:
+		Mirko Brombin <mirko@fabricators.ltd>
+		Vanilla OS Contributors <https://github.com/vanilla-os/>
+	Copyright: 2024
+	Description:
+		ABRoot is utility which provides full immutability and
+		atomicity to a Linux system, by transacting between
+		two root filesystems. Updates are performed using OCI
+		images, to ensure that the system is always in a
+		consistent state.
+*/
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/vanilla-os/abroot/settings"
+)
+
+// repoCheckWorkers is the maximum number of concurrent repo requests made
+// by WarmCache and by the repo checks of several packages at once
+const repoCheckWorkers = 4
+
+// RepoStats are the aggregate durations of the requests made to the repo API
+type RepoStats struct {
+	Count int
+	Min   time.Duration
+	Max   time.Duration
+	Avg   time.Duration
+}
+
+// repoTimings accumulates the durations of the repo API requests
+type repoTimings struct {
+	mutex sync.Mutex
+	count int
+	total time.Duration
+	min   time.Duration
+	max   time.Duration
+}
+
+var repoStats repoTimings
+
+func (r *repoTimings) record(d time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.count == 0 || d < r.min {
+		r.min = d
+	}
+	if d > r.max {
+		r.max = d
+	}
+	r.count++
+	r.total += d
+}
+
+// RepoTimingStats returns the aggregate durations of the repo API requests
+// made since the start of the program or the last ResetRepoStats call
+func RepoTimingStats() RepoStats {
+	repoStats.mutex.Lock()
+	defer repoStats.mutex.Unlock()
+
+	stats := RepoStats{
+		Count: repoStats.count,
+		Min:   repoStats.min,
+		Max:   repoStats.max,
+	}
+	if repoStats.count > 0 {
+		stats.Avg = repoStats.total / time.Duration(repoStats.count)
+	}
+
+	return stats
+}
+
+// ResetRepoStats clears the repo API request durations
+func ResetRepoStats() {
+	repoStats.mutex.Lock()
+	defer repoStats.mutex.Unlock()
+
+	repoStats.count = 0
+	repoStats.total = 0
+	repoStats.min = 0
+	repoStats.max = 0
+}
+
+// repoClientSettings are the settings the shared repo client is built from
+type repoClientSettings struct {
+	maxIdleConnsPerHost int
+	keepAlive           int
+	http2               bool
+	timeout             int
+}
+
+// sharedRepoClient is the client used for the repo API requests, it is
+// rebuilt when the settings it was built from change
+var sharedRepoClient struct {
+	mutex    sync.Mutex
+	client   *http.Client
+	settings repoClientSettings
+}
+
+// NewRepoHTTPClient returns a client for the repo API, with the connection
+// reuse tunables and the request timeout taken from the settings
+func NewRepoHTTPClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = settings.Cnf.IPkgMngMaxIdleConnsPerHost
+	transport.ForceAttemptHTTP2 = settings.Cnf.IPkgMngHTTP2
+	transport.DialContext = (&net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: time.Duration(settings.Cnf.IPkgMngKeepAlive) * time.Second,
+	}).DialContext
+
+	if !settings.Cnf.IPkgMngHTTP2 {
+		// a non-nil empty map disables the HTTP/2 upgrade
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   time.Duration(settings.Cnf.IPkgMngTimeout) * time.Second,
+	}
+}
+
+// repoHTTPClient returns the shared repo client, so that connections are
+// reused across requests
+func repoHTTPClient() *http.Client {
+	sharedRepoClient.mutex.Lock()
+	defer sharedRepoClient.mutex.Unlock()
+
+	current := repoClientSettings{
+		maxIdleConnsPerHost: settings.Cnf.IPkgMngMaxIdleConnsPerHost,
+		keepAlive:           settings.Cnf.IPkgMngKeepAlive,
+		http2:               settings.Cnf.IPkgMngHTTP2,
+		timeout:             settings.Cnf.IPkgMngTimeout,
+	}
+	if sharedRepoClient.client == nil || sharedRepoClient.settings != current {
+		sharedRepoClient.client = NewRepoHTTPClient()
+		sharedRepoClient.settings = current
+	}
+
+	return sharedRepoClient.client
+}
+
+// RepoClient performs the requests to the repo API, *http.Client implements
+// it
+type RepoClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// SetRepoClient sets the client performing the repo API requests of the
+// package manager, nil restores the shared client
+func (p *PackageManager) SetRepoClient(client RepoClient) {
+	p.repoClient = client
+}
+
+// ErrOffline is returned by the repo queries of a package manager in offline
+// mode
+var ErrOffline = errors.New("the package manager is in offline mode, the repo is not queried")
+
+// offlineRepoClient is the RepoClient of a package manager in offline mode,
+// it fails every request without any network access
+type offlineRepoClient struct{}
+
+func (offlineRepoClient) Do(req *http.Request) (*http.Response, error) {
+	return nil, ErrOffline
+}
+
+// SetOffline enables or disables the offline mode, which defaults to the
+// IPkgMngOffline setting. In offline mode the repo checks always succeed
+// without querying the repo, while the queries for package information fail
+// with ErrOffline. This is meant for machines without network access, where
+// the repo API is configured but unreachable
+func (p *PackageManager) SetOffline(offline bool) {
+	p.offline = offline
+}
+
+// Offline reports whether the package manager is in offline mode
+func (p *PackageManager) Offline() bool {
+	return p.offline
+}
+
+// ApiWarning returns the repo API misconfiguration found when the package
+// manager was created, nil if there is none. It is only reported this way
+// if IPkgMngStrictApi is not set, otherwise the creation fails
+func (p *PackageManager) ApiWarning() error {
+	return p.apiWarning
+}
+
+// client returns the repo client in use
+func (p *PackageManager) client() RepoClient {
+	if p.offline {
+		return offlineRepoClient{}
+	}
+	if p.repoClient == nil {
+		return repoHTTPClient()
+	}
+
+	return p.repoClient
+}
+
+// repoConns bounds the number of concurrent repo API requests across all
+// the package managers, it is resized when the IPkgMngMaxConns setting
+// changes
+var repoConns struct {
+	mutex sync.Mutex
+	slots chan struct{}
+	size  int
+}
+
+// acquireRepoConn waits for a free repo connection slot and returns the
+// function releasing it, or the error of the context if it is done first.
+// No limit is applied if IPkgMngMaxConns is not positive
+func acquireRepoConn(ctx context.Context) (func(), error) {
+	repoConns.mutex.Lock()
+	if repoConns.slots == nil || repoConns.size != settings.Cnf.IPkgMngMaxConns {
+		repoConns.size = settings.Cnf.IPkgMngMaxConns
+		repoConns.slots = nil
+		if repoConns.size > 0 {
+			repoConns.slots = make(chan struct{}, repoConns.size)
+		}
+	}
+	slots := repoConns.slots
+	repoConns.mutex.Unlock()
+
+	if slots == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() { <-slots })
+	}, nil
+}
+
+// releasingBody releases the repo connection slot of a response once its
+// body is closed
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
+
+// repoGet performs a GET request to the repo API, recording its duration.
+// Failed requests are recorded as well, since they are part of the latency
+// experienced by the user. Transient failures are retried, see
+// repoShouldRetry
+func repoGet(ctx context.Context, client RepoClient, url string) (*http.Response, error) {
+	return repoRequest(ctx, client, http.MethodGet, url)
+}
+
+// repoHead performs a HEAD request to the repo API, falling back to a GET
+// request if the server does not support HEAD
+func repoHead(ctx context.Context, client RepoClient, url string) (*http.Response, error) {
+	resp, err := repoRequest(ctx, client, http.MethodHead, url)
+	if err != nil || (resp.StatusCode != http.StatusMethodNotAllowed && resp.StatusCode != http.StatusNotImplemented) {
+		return resp, err
+	}
+	resp.Body.Close()
+
+	PrintVerboseInfo("PackageManager.repoHead", "HEAD not supported by the repo, falling back to GET")
+	return repoGet(ctx, client, url)
+}
+
+// repoRequest performs a request to the repo API, retrying it on transient
+// failures. Cancelling the context aborts the request in flight as well as
+// the wait before a retry
+func repoRequest(ctx context.Context, client RepoClient, method, url string) (*http.Response, error) {
+	attempts := max(settings.Cnf.IPkgMngRetryAttempts, 1)
+	for attempt := 1; ; attempt++ {
+		resp, err := repoRequestOnce(ctx, client, method, url)
+		// a cancelled request fails like a timeout, it is never retried
+		if attempt == attempts || ctx.Err() != nil || !repoShouldRetry(resp, err) {
+			return resp, err
+		}
+		if !takeRepoRetry(ctx) {
+			PrintVerboseWarn("PackageManager.repoRequest", 1, "retry budget exhausted, not retrying")
+			return resp, err
+		}
+
+		if err == nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		delay := repoRetryDelay(attempt)
+		PrintVerboseWarn("PackageManager.repoRequest", 0, "transient repo failure, retrying in", delay)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// repoRequestOnce performs a single request to the repo API
+func repoRequestOnce(ctx context.Context, client RepoClient, method, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	// setting the header disables the transparent decompression of the
+	// transport, the body is decoded by decodeRepoBody instead, which also
+	// covers deflate and the custom clients
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	// the headers may carry credentials, they are never logged
+	for name, value := range settings.Cnf.IPkgMngApiHeaders {
+		req.Header.Set(name, value)
+	}
+
+	// the slot is held until the body is closed, since the connection
+	// is in use until then
+	release, err := acquireRepoConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	repoStats.record(time.Since(start))
+	if err == nil && resp == nil {
+		err = errors.New("the repo client returned no response for " + url)
+	}
+	if err != nil {
+		release()
+		return nil, err
+	}
+
+	// callers always close the body, custom clients may leave it nil
+	if resp.Body == nil {
+		resp.Body = http.NoBody
+	}
+	err = decodeRepoBody(resp)
+	if err != nil {
+		resp.Body.Close()
+		release()
+		return nil, err
+	}
+	resp.Body = &releasingBody{resp.Body, release}
+
+	return resp, nil
+}
+
+// decodedBody is a response body read through a decompressor, closing it
+// closes both
+type decodedBody struct {
+	io.Reader
+	decoder io.Closer
+	body    io.Closer
+}
+
+func (b *decodedBody) Close() error {
+	b.decoder.Close()
+	return b.body.Close()
+}
+
+// decodeRepoBody transparently decompresses a gzip or deflate encoded
+// response body. Deflate bodies are accepted both with and without the zlib
+// wrapper, since servers disagree on it
+func decodeRepoBody(resp *http.Response) error {
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	if encoding == "" || encoding == "identity" || resp.Request != nil && resp.Request.Method == http.MethodHead {
+		return nil
+	}
+
+	var decoder io.ReadCloser
+	switch encoding {
+	case "gzip", "x-gzip":
+		body := bufio.NewReader(resp.Body)
+		_, err := body.Peek(1)
+		if err != nil {
+			// empty body, nothing to decode
+			return nil
+		}
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return fmt.Errorf("malformed gzip response from the repo: %w", err)
+		}
+		decoder = gz
+	case "deflate":
+		body := bufio.NewReader(resp.Body)
+		header, err := body.Peek(2)
+		if err != nil {
+			// empty body, nothing to decode
+			return nil
+		}
+		if header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+			decoder, err = zlib.NewReader(body)
+			if err != nil {
+				return fmt.Errorf("malformed deflate response from the repo: %w", err)
+			}
+		} else {
+			decoder = flate.NewReader(body)
+		}
+	default:
+		// not an encoding we asked for, the body is left to the caller
+		PrintVerboseWarn("PackageManager.decodeRepoBody", 0, "unsupported content encoding from the repo:", encoding)
+		return nil
+	}
+
+	resp.Body = &decodedBody{decoder, decoder, resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+
+	return nil
+}
+
+// repoShouldRetry reports whether a repo request failed transiently: 5xx and
+// 429 responses, timeouts, refused or reset connections and connections
+// closed early are retried. Any other error is permanent, such as the
+// certificate and TLS failures, the invalid urls or the ones of the offline
+// mode, and is not retried
+func repoShouldRetry(resp *http.Response, err error) bool {
+	if err == nil {
+		return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// retryBudget is the number of retries left to the repo requests of a batch
+// operation, see withRetryBudget
+type retryBudget struct {
+	mutex     sync.Mutex
+	remaining int
+}
+
+type retryBudgetKey struct{}
+
+// withRetryBudget returns a context whose repo requests share a budget of
+// IPkgMngRetryBudget retries, so that a failing repo does not make every
+// request of a batch operation retry fully. No budget is applied if the
+// setting is not positive
+func withRetryBudget(ctx context.Context) context.Context {
+	if settings.Cnf.IPkgMngRetryBudget <= 0 {
+		return ctx
+	}
+
+	return context.WithValue(ctx, retryBudgetKey{}, &retryBudget{remaining: settings.Cnf.IPkgMngRetryBudget})
+}
+
+// takeRepoRetry reports whether the retry budget of the given context, if
+// any, allows one more retry, consuming it
+func takeRepoRetry(ctx context.Context) bool {
+	budget, ok := ctx.Value(retryBudgetKey{}).(*retryBudget)
+	if !ok {
+		return true
+	}
+
+	budget.mutex.Lock()
+	defer budget.mutex.Unlock()
+
+	if budget.remaining <= 0 {
+		return false
+	}
+	budget.remaining--
+	return true
+}
+
+// repoRetryDelay returns the delay before the given retry, doubling at each
+// attempt from IPkgMngRetryDelay with up to 50% of jitter
+func repoRetryDelay(attempt int) time.Duration {
+	delay := time.Duration(settings.Cnf.IPkgMngRetryDelay) * time.Millisecond << (attempt - 1)
+	if delay <= 0 {
+		return 0
+	}
+
+	return delay + time.Duration(rand.Int63n(int64(delay)/2+1))
+}
+
+// RecordingRepoClient is a RepoClient which answers with canned responses
+// and records the requested URLs, meant for tests. Responses maps URLs to
+// JSON bodies, it answers with a 404 for any other URL
+type RecordingRepoClient struct {
+	Responses map[string]string
+
+	mutex    sync.Mutex
+	requests []string
+}
+
+// NewRecordingRepoClient returns a RecordingRepoClient answering with the
+// given responses
+func NewRecordingRepoClient(responses map[string]string) *RecordingRepoClient {
+	return &RecordingRepoClient{Responses: responses}
+}
+
+// Do implements RepoClient
+func (c *RecordingRepoClient) Do(req *http.Request) (*http.Response, error) {
+	url := req.URL.String()
+
+	c.mutex.Lock()
+	c.requests = append(c.requests, url)
+	c.mutex.Unlock()
+
+	resp := &http.Response{
+		StatusCode: http.StatusNotFound,
+		Status:     http.StatusText(http.StatusNotFound),
+		Header:     http.Header{},
+		Body:       http.NoBody,
+		Request:    req,
+	}
+
+	body, ok := c.Responses[url]
+	if ok {
+		resp.StatusCode = http.StatusOK
+		resp.Status = http.StatusText(http.StatusOK)
+		resp.Header.Set("Content-Type", "application/json")
+		resp.Body = io.NopCloser(strings.NewReader(body))
+		resp.ContentLength = int64(len(body))
+	}
+
+	return resp, nil
+}
+
+// Requests returns the URLs requested so far, in order
+func (c *RecordingRepoClient) Requests() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return append([]string{}, c.requests...)
+}
+
+// repoCache keeps the status codes of the repo API responses by url, so that
+// the same package is not checked twice. Only definitive answers are cached,
+// network errors and server errors are not. Entries expire after
+// IPkgMngCacheTTL seconds, a TTL of 0 disables the cache
+type repoCache struct {
+	mutex   sync.Mutex
+	entries map[string]repoCacheEntry
+}
+
+type repoCacheEntry struct {
+	status  int
+	expires time.Time
+}
+
+func (c *repoCache) get(url string) (int, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry, ok := c.entries[url]
+	if !ok || time.Now().After(entry.expires) {
+		delete(c.entries, url)
+		return 0, false
+	}
+
+	return entry.status, true
+}
+
+// set caches the status of an url, only definitive answers are cached so
+// that an authentication failure or a rate limit is not remembered as a
+// missing package
+func (c *repoCache) set(url string, status int) {
+	if !repoStatusCacheable(status) || settings.Cnf.IPkgMngCacheTTL <= 0 {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.entries == nil {
+		c.entries = map[string]repoCacheEntry{}
+	}
+	c.entries[url] = repoCacheEntry{
+		status:  status,
+		expires: time.Now().Add(time.Duration(settings.Cnf.IPkgMngCacheTTL) * time.Second),
+	}
+}
+
+// WarmCache checks every added package in the repo in the background,
+// populating the cache used by ExistsInRepo so that later checks are
+// instant. Packages missing from the repo are not considered failures, while
+// the errors of the requests which could not complete are returned joined,
+// after every other package has been checked. It stops early if the context
+// is cancelled
+func (p *PackageManager) WarmCache(ctx context.Context) error {
+	PrintVerboseInfo("PackageManager.WarmCache", "running...")
+
+	pkgs, err := p.GetAddPackages()
+	if err != nil {
+		PrintVerboseErr("PackageManager.WarmCache", 0, err)
+		return err
+	}
+
+	names := []string{}
+	for _, pkg := range pkgs {
+		pkgNames, _ := splitPackageOptions(pkg)
+		names = append(names, strings.Fields(pkgNames)...)
+	}
+
+	var (
+		wg    sync.WaitGroup
+		mutex sync.Mutex
+		errs  []error
+	)
+	slots := make(chan struct{}, repoCheckWorkers)
+
+loop:
+	for _, name := range names {
+		select {
+		case <-ctx.Done():
+			break loop
+		case slots <- struct{}{}:
+		}
+
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			status, err := p.existsInRepo(ctx, name)
+			if err != nil && status == 0 {
+				PrintVerboseErr("PackageManager.WarmCache", 1, err)
+				mutex.Lock()
+				errs = append(errs, err)
+				mutex.Unlock()
+			}
+		}(name)
+	}
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		PrintVerboseErr("PackageManager.WarmCache", 2, ctx.Err())
+		return ctx.Err()
+	}
+
+	return errors.Join(errs...)
+}
+
+// isJSONResponse checks whether the content type of a response is JSON
+func isJSONResponse(resp *http.Response) bool {
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
@@ -0,0 +1,203 @@
+package core
+
+/*	License: GPLv3
+	Authors:
+		Mirko Brombin <mirko@fabricators.ltd>
+		Vanilla OS Contributors <https://github.com/vanilla-os/>
+	Copyright: 2024
+	Description:
+		ABRoot is utility which provides full immutability and
+		atomicity to a Linux system, by transacting between
+		two root filesystems. Updates are performed using OCI
+		images, to ensure that the system is always in a
+		consistent state.
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+)
+
+// PackageStateVersion is the version of the PackageState format written by
+// ExportState
+const PackageStateVersion = 1
+
+// ErrPackageManagerDisabled is returned by the operations refusing to run
+// while the package manager is disabled
+var ErrPackageManagerDisabled = errors.New("the package manager is disabled")
+
+// PackageState is the whole package state of a package manager: the
+// packages.add, packages.remove and packages.unstaged lists, as exported by
+// ExportState for backups and migrations between installs
+type PackageState struct {
+	Version  int                    `json:"version"`
+	Add      []string               `json:"add"`
+	Remove   []string               `json:"remove"`
+	Unstaged []PackageStateUnstaged `json:"unstaged"`
+}
+
+// PackageStateUnstaged is an unstaged package change of a PackageState
+type PackageStateUnstaged struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+}
+
+// ExportState writes the package state to the given path as a versioned
+// JSON document, see ImportState
+func (p *PackageManager) ExportState(path string) error {
+	PrintVerboseInfo("PackageManager.ExportState", "running...")
+
+	pkgsAdd, pkgsRemove, upkgs, err := p.readPackageStates()
+	if err != nil {
+		PrintVerboseErr("PackageManager.ExportState", 0, err)
+		return err
+	}
+
+	state := PackageState{
+		Version:  PackageStateVersion,
+		Add:      dedupPackages(pkgsAdd),
+		Remove:   dedupPackages(pkgsRemove),
+		Unstaged: []PackageStateUnstaged{},
+	}
+	for _, upkg := range resolveUnstagedPackages(upkgs) {
+		state.Unstaged = append(state.Unstaged, PackageStateUnstaged{upkg.Name, upkg.Status})
+	}
+
+	content, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		PrintVerboseErr("PackageManager.ExportState", 1, err)
+		return err
+	}
+
+	err = os.WriteFile(path, append(content, '\n'), packagesFileMode)
+	if err != nil {
+		PrintVerboseErr("PackageManager.ExportState", 2, err)
+		return err
+	}
+
+	return nil
+}
+
+// ImportState replaces the package state with the one exported to the given
+// path by ExportState. Every package name is validated before any file is
+// written, packages are not checked in the repo. It refuses to run while the
+// package manager is disabled
+func (p *PackageManager) ImportState(path string) error {
+	PrintVerboseInfo("PackageManager.ImportState", "running...")
+
+	if p.Status == PKG_MNG_DISABLED {
+		PrintVerboseErr("PackageManager.ImportState", 0, ErrPackageManagerDisabled)
+		return ErrPackageManagerDisabled
+	}
+
+	err := p.CheckStatus()
+	if err != nil {
+		PrintVerboseErr("PackageManager.ImportState", 0.1, err)
+		return err
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		PrintVerboseErr("PackageManager.ImportState", 1, err)
+		return err
+	}
+
+	state := PackageState{}
+	err = json.Unmarshal(content, &state)
+	if err != nil {
+		PrintVerboseErr("PackageManager.ImportState", 2, err)
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if state.Version < 1 || state.Version > PackageStateVersion {
+		err = fmt.Errorf("%s: unsupported state version %d, the newest supported one is %d", path, state.Version, PackageStateVersion)
+		PrintVerboseErr("PackageManager.ImportState", 3, err)
+		return err
+	}
+
+	upkgs := []UnstagedPackage{}
+	names := slices.Concat(state.Add, state.Remove)
+	for _, upkg := range state.Unstaged {
+		if upkg.Status != ADD && upkg.Status != REMOVE {
+			err = fmt.Errorf("%s: unknown status %q for %s", path, upkg.Status, upkg.Name)
+			PrintVerboseErr("PackageManager.ImportState", 4, err)
+			return err
+		}
+		upkgs = append(upkgs, UnstagedPackage{upkg.Name, upkg.Status})
+		names = append(names, upkg.Name)
+	}
+	for _, name := range names {
+		err = validatePackageName(name, true)
+		if err != nil {
+			PrintVerboseErr("PackageManager.ImportState", 5, err)
+			return err
+		}
+	}
+
+	unlock, err := p.lock()
+	if err != nil {
+		PrintVerboseErr("PackageManager.ImportState", 6, err)
+		return err
+	}
+	defer unlock()
+
+	err = p.writeAddPackages(state.Add)
+	if err != nil {
+		PrintVerboseErr("PackageManager.ImportState", 7, err)
+		return err
+	}
+	err = p.writeRemovePackages(state.Remove)
+	if err != nil {
+		PrintVerboseErr("PackageManager.ImportState", 8, err)
+		return err
+	}
+	err = p.writeUnstagedPackages(upkgs)
+	if err != nil {
+		PrintVerboseErr("PackageManager.ImportState", 9, err)
+		return err
+	}
+
+	return nil
+}
+
+// DiffStates compares the packages.add and packages.remove files of the
+// package manager, e.g. the one of the booted root, with the ones of other,
+// e.g. the one of the next root. The added packages are the ones other adds
+// or stops removing, the removed ones are the ones other removes or stops
+// adding. Unstaged changes are not taken into account
+func (p *PackageManager) DiffStates(other *PackageManager) (added []string, removed []string, err error) {
+	PrintVerboseInfo("PackageManager.DiffStates", "running...")
+
+	currentAdd, currentRemove, _, err := p.mergeSets()
+	if err != nil {
+		PrintVerboseErr("PackageManager.DiffStates", 0, err)
+		return nil, nil, err
+	}
+	otherAdd, otherRemove, _, err := other.mergeSets()
+	if err != nil {
+		PrintVerboseErr("PackageManager.DiffStates", 1, err)
+		return nil, nil, err
+	}
+
+	currentAdd, currentRemove = packageNames(currentAdd), packageNames(currentRemove)
+	otherAdd, otherRemove = packageNames(otherAdd), packageNames(otherRemove)
+
+	added = []string{}
+	removed = []string{}
+	appendMissing := func(diff []string, pkgs []string, reference []string) []string {
+		for _, pkg := range pkgs {
+			if !slices.Contains(reference, pkg) && !slices.Contains(diff, pkg) {
+				diff = append(diff, pkg)
+			}
+		}
+		return diff
+	}
+	added = appendMissing(added, otherAdd, currentAdd)
+	added = appendMissing(added, currentRemove, otherRemove)
+	removed = appendMissing(removed, otherRemove, currentRemove)
+	removed = appendMissing(removed, currentAdd, otherAdd)
+
+	return added, removed, nil
+}
@@ -0,0 +1,170 @@
+package core
+
+/*	License: GPLv3
+	Authors:
+		Mirko Brombin <mirko@fabricators.ltd>
+		Vanilla OS Contributors <https://github.com/vanilla-os/>
+	Copyright: 2024
+	Description:
+		ABRoot is utility which provides full immutability and
+		atomicity to a Linux system, by transacting between
+		two root filesystems. Updates are performed using OCI
+		images, to ensure that the system is always in a
+		consistent state.
+*/
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/vanilla-os/abroot/settings"
+)
+
+// maxSuggestions is the maximum number of package names SuggestPackages
+// returns
+const maxSuggestions = 3
+
+// SuggestPackages returns the package names of the repository closest to the
+// given one by edit distance, closest first, e.g. to suggest a fix for a
+// misspelled package which was not found. The names are read from
+// iPkgMngApiIndex, which is fetched once per package manager. Names are only
+// suggested if they are at most a third of their length away, with at least
+// two edits allowed
+func (p *PackageManager) SuggestPackages(pkg string) ([]string, error) {
+	PrintVerboseInfo("PackageManager.SuggestPackages", "running...")
+
+	index, err := p.getPackageIndex()
+	if err != nil {
+		PrintVerboseErr("PackageManager.SuggestPackages", 0, err)
+		return nil, err
+	}
+
+	type suggestion struct {
+		name     string
+		distance int
+	}
+	suggestions := []suggestion{}
+	for _, name := range index {
+		if name == pkg {
+			continue
+		}
+		distance := levenshtein(pkg, name)
+		if distance <= max(2, len(name)/3) {
+			suggestions = append(suggestions, suggestion{name, distance})
+		}
+	}
+	sort.Slice(suggestions, func(i, j int) bool {
+		if suggestions[i].distance != suggestions[j].distance {
+			return suggestions[i].distance < suggestions[j].distance
+		}
+		return suggestions[i].name < suggestions[j].name
+	})
+
+	names := []string{}
+	for i := 0; i < len(suggestions) && i < maxSuggestions; i++ {
+		names = append(names, suggestions[i].name)
+	}
+
+	return names, nil
+}
+
+// getPackageIndex returns the package names of iPkgMngApiIndex, fetching
+// them on first use
+func (p *PackageManager) getPackageIndex() ([]string, error) {
+	if p.packageIndex != nil {
+		return p.packageIndex, nil
+	}
+	if settings.Cnf.IPkgMngApiIndex == "" {
+		return nil, errors.New("no package index configured, iPkgMngApiIndex is not set")
+	}
+
+	url := strings.ReplaceAll(settings.Cnf.IPkgMngApiIndex, "{branch}", settings.Cnf.IPkgMngBranch)
+	resp, err := repoGet(context.Background(), p.client(), url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("package index replied with status %d", resp.StatusCode)
+	}
+
+	// the index lists either the names or objects holding them
+	entries := []json.RawMessage{}
+	err = json.NewDecoder(resp.Body).Decode(&entries)
+	if err != nil {
+		return nil, fmt.Errorf("malformed package index: %w", err)
+	}
+
+	index := []string{}
+	for _, entry := range entries {
+		var name string
+		if json.Unmarshal(entry, &name) != nil {
+			pkgInfo := struct {
+				Name string `json:"name"`
+			}{}
+			err = json.Unmarshal(entry, &pkgInfo)
+			if err != nil {
+				return nil, fmt.Errorf("malformed package index entry %s: %w", entry, err)
+			}
+			name = pkgInfo.Name
+		}
+		if name != "" {
+			index = append(index, name)
+		}
+	}
+
+	p.packageIndex = index
+	return index, nil
+}
+
+// MissingPackages returns the packages reported missing from the repository
+// by an error, such as the one of Add. The whole error tree is walked, unlike
+// errors.As, so that every package of joined errors, such as the one of
+// AddMany, is returned
+func MissingPackages(err error) []string {
+	switch e := err.(type) {
+	case *ErrPackageNotFound:
+		return []string{e.Package}
+	case interface{ Unwrap() []error }:
+		missing := []string{}
+		for _, err := range e.Unwrap() {
+			missing = append(missing, MissingPackages(err)...)
+		}
+		return missing
+	case interface{ Unwrap() error }:
+		return MissingPackages(e.Unwrap())
+	}
+
+	return []string{}
+}
+
+// levenshtein returns the edit distance between two strings, the number of
+// single character insertions, deletions and substitutions turning a into b
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+
+	previous := make([]int, len(rb)+1)
+	current := make([]int, len(rb)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		current[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+
+	return previous[len(rb)]
+}
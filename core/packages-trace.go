@@ -0,0 +1,94 @@
+package core
+
+/*	License: GPLv3
+	Authors:
+		Mirko Brombin <mirko@fabricators.ltd>
+		Vanilla OS Contributors <https://github.com/vanilla-os/>
+	Copyright: 2024
+	Description:
+		ABRoot is utility which provides full immutability and
+		atomicity to a Linux system, by transacting between
+		two root filesystems. Updates are performed using OCI
+		images, to ensure that the system is always in a
+		consistent state.
+*/
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vanilla-os/abroot/settings"
+)
+
+// traceBufferSize is the number of events kept by the package manager
+// trace, older events get overwritten
+const traceBufferSize = 256
+
+// TraceEvent is an operation recorded by the package manager trace
+type TraceEvent struct {
+	Time      time.Time
+	Operation string
+	Details   string
+}
+
+// traceBuffer is a ring buffer of trace events
+type traceBuffer struct {
+	mutex  sync.Mutex
+	events []TraceEvent
+	next   int
+}
+
+// trace records an operation in the package manager trace, if enabled
+// by settings.Cnf.IPkgMngTrace
+func (p *PackageManager) trace(operation string, details ...interface{}) {
+	if !settings.Cnf.IPkgMngTrace {
+		return
+	}
+
+	detailsFmt := []string{}
+	for _, detail := range details {
+		detailsFmt = append(detailsFmt, fmt.Sprint(detail))
+	}
+
+	p.traceEvents.mutex.Lock()
+	defer p.traceEvents.mutex.Unlock()
+
+	event := TraceEvent{time.Now(), operation, strings.Join(detailsFmt, " ")}
+	if len(p.traceEvents.events) < traceBufferSize {
+		p.traceEvents.events = append(p.traceEvents.events, event)
+		return
+	}
+
+	p.traceEvents.events[p.traceEvents.next] = event
+	p.traceEvents.next = (p.traceEvents.next + 1) % traceBufferSize
+}
+
+// GetTrace returns the recorded trace events, oldest first
+func (p *PackageManager) GetTrace() []TraceEvent {
+	p.traceEvents.mutex.Lock()
+	defer p.traceEvents.mutex.Unlock()
+
+	events := []TraceEvent{}
+	events = append(events, p.traceEvents.events[p.traceEvents.next:]...)
+	events = append(events, p.traceEvents.events[:p.traceEvents.next]...)
+	return events
+}
+
+// DumpTrace writes the recorded trace events to w, one per line and
+// oldest first
+func (p *PackageManager) DumpTrace(w io.Writer) error {
+	PrintVerboseInfo("PackageManager.DumpTrace", "running...")
+
+	for _, event := range p.GetTrace() {
+		_, err := fmt.Fprintf(w, "%s %s %s\n", event.Time.Format(time.RFC3339Nano), event.Operation, event.Details)
+		if err != nil {
+			PrintVerboseErr("PackageManager.DumpTrace", 0, err)
+			return err
+		}
+	}
+
+	return nil
+}
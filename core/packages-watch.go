@@ -0,0 +1,135 @@
+package core
+
+/*	License: GPLv3
+	Authors:
+		Mirko Brombin <mirko@fabricators.ltd>
+		Vanilla OS Contributors <https://github.com/vanilla-os/>
+	Copyright: 2024
+	Description:
+		ABRoot is utility which provides full immutability and
+		atomicity to a Linux system, by transacting between
+		two root filesystems. Updates are performed using OCI
+		images, to ensure that the system is always in a
+		consistent state.
+*/
+
+import (
+	"context"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchCoalesceDelay is how long Watch waits for further changes before
+// emitting an event, so that a burst of writes gives a single event
+const watchCoalesceDelay = 100 * time.Millisecond
+
+// watchedFiles are the package files whose changes are reported by Watch
+var watchedFiles = map[string]bool{
+	PackagesAddFile:      true,
+	PackagesRemoveFile:   true,
+	PackagesUnstagedFile: true,
+}
+
+// StateEvent is emitted by Watch when the package files change. It holds
+// the names of the changed files and the state read after the change, Err
+// is set if the state could not be read
+type StateEvent struct {
+	Files    []string
+	Add      []string
+	Remove   []string
+	Unstaged []UnstagedPackage
+	Err      error
+}
+
+// Watch reports the changes made to the add, remove and unstaged package
+// files, including the ones made by other processes. Changes happening
+// within a short delay are coalesced into a single event. The channel is
+// closed when the context is cancelled
+func (p *PackageManager) Watch(ctx context.Context) (<-chan StateEvent, error) {
+	PrintVerboseInfo("PackageManager.Watch", "running...")
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		PrintVerboseErr("PackageManager.Watch", 0, err)
+		return nil, err
+	}
+
+	// the directory is watched rather than the files, since they may be
+	// missing or get replaced
+	err = watcher.Add(p.baseDir)
+	if err != nil {
+		watcher.Close()
+		PrintVerboseErr("PackageManager.Watch", 1, err)
+		return nil, err
+	}
+
+	events := make(chan StateEvent)
+	go func() {
+		defer close(events)
+		defer watcher.Close()
+
+		changed := map[string]bool{}
+		var coalesce <-chan time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				file := filepath.Base(event.Name)
+				if !watchedFiles[file] || event.Op == fsnotify.Chmod {
+					continue
+				}
+
+				changed[file] = true
+				if coalesce == nil {
+					coalesce = time.After(watchCoalesceDelay)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				PrintVerboseWarn("PackageManager.Watch", 2, err)
+			case <-coalesce:
+				coalesce = nil
+				state := p.stateEvent(changed)
+				changed = map[string]bool{}
+
+				select {
+				case events <- state:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return events, nil
+}
+
+// stateEvent reads the current state into a StateEvent for the changed
+// files
+func (p *PackageManager) stateEvent(changed map[string]bool) StateEvent {
+	state := StateEvent{Files: []string{}}
+	for file := range changed {
+		state.Files = append(state.Files, file)
+	}
+	sort.Strings(state.Files)
+
+	state.Add, state.Err = p.GetAddPackages()
+	if state.Err != nil {
+		return state
+	}
+	state.Remove, state.Err = p.GetRemovePackages()
+	if state.Err != nil {
+		return state
+	}
+	state.Unstaged, state.Err = p.GetUnstagedPackages()
+
+	return state
+}
@@ -14,6 +14,7 @@ package core
 */
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -21,11 +22,18 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
 
 	"github.com/vanilla-os/abroot/settings"
+	"golang.org/x/sync/singleflight"
 )
 
 // PackageManager struct
@@ -33,6 +41,65 @@ type PackageManager struct {
 	dryRun  bool
 	baseDir string
 	Status  ABRootPkgManagerStatus
+
+	// validationSuspended makes Add and Remove skip the repo checks, the
+	// skipped packages are kept in pendingValidation until RevalidateAll
+	validationSuspended bool
+	pendingValidation   []string
+
+	lastFailed []FailedPackage
+
+	lastLicenseViolations []LicenseViolation
+
+	lastRemovalImpacts []RemovalImpact
+
+	// resultsMutex guards the pending validations and the results of the
+	// last checks, since the checks run outside of the package files lock
+	resultsMutex sync.Mutex
+
+	traceEvents traceBuffer
+
+	repoCache repoCache
+
+	// repoFlight deduplicates the concurrent repo checks, see existsAtURL
+	repoFlight singleflight.Group
+
+	installedChecker InstalledChecker
+
+	// mutex serializes the package files changes within the process, see
+	// lock
+	mutex sync.Mutex
+
+	// lockTimeout is how long to wait for the package files lock
+	lockTimeout time.Duration
+
+	// actor is recorded in the change history, the current user is used
+	// when empty
+	actor string
+
+	commandBuilder CommandBuilder
+
+	// backend builds the commands and checks the repo, see SetBackend
+	backend Backend
+
+	// repoClient performs the repo API requests, the shared client is
+	// used when nil
+	repoClient RepoClient
+
+	// offline skips the repo checks, see SetOffline
+	offline bool
+
+	// apiWarning is the repo API misconfiguration found on creation, see
+	// ApiWarning
+	apiWarning error
+
+	// packageIndex caches the package names of iPkgMngApiIndex, see
+	// SuggestPackages
+	packageIndex []string
+
+	// CommandPolicy, if set, can veto the command built for an operation
+	// by returning an error
+	CommandPolicy func(plan CommandPlan) error
 }
 
 // Common Package manager paths
@@ -43,14 +110,50 @@ const (
 	PackagesAddFile             = "packages.add"
 	PackagesRemoveFile          = "packages.remove"
 	PackagesUnstagedFile        = "packages.unstaged"
+	PackagesLastApplyFile       = "packages.lastapply"
+	PackagesRemoveDefaultsFile  = "packages.removedefaults"
+	PackagesHoldFile            = "packages.hold"
+	PackagesExcludeFile         = "packages.exclude"
+	PackagesHistoryFile         = "packages.history"
+	PackagesHistoryRotatedFile  = "packages.history.1"
 )
 
+// packageFiles are the files the package manager keeps in its base directory,
+// the user agreement file aside
+var packageFiles = []string{
+	PackagesAddFile,
+	PackagesRemoveFile,
+	PackagesUnstagedFile,
+	PackagesLastApplyFile,
+	PackagesRemoveDefaultsFile,
+	PackagesHoldFile,
+	PackagesExcludeFile,
+	PackagesHistoryFile,
+	PackagesHistoryRotatedFile,
+}
+
 // Package manager operations
 const (
 	ADD    = "+"
 	REMOVE = "-"
 )
 
+// Package files format, files without a format header are version 1, while
+// version 2 files start with the header. Both may contain comments, see
+// stripPackageComment
+const (
+	PackageFileFormatHeader  = "# abroot-format:"
+	PackageFileFormatVersion = 2
+)
+
+// PackageOptionsSeparator separates a package name from its install options
+// in the package files, e.g. "firefox||--no-install-recommends"
+const PackageOptionsSeparator = "||"
+
+// SummaryPendingPrefix marks the unstaged changes in the summary returned by
+// GetSummaryWithUnstaged, e.g. "~+ firefox" is an addition yet to be applied
+const SummaryPendingPrefix = "~"
+
 // Package manager statuses
 const (
 	PKG_MNG_DISABLED      = 0
@@ -72,6 +175,175 @@ type UnstagedPackage struct {
 	Name, Status string
 }
 
+// FailedPackage is a package which failed the repo check during a batch
+// operation. Status is the status code of the repo response, 0 if no
+// response was received
+type FailedPackage struct {
+	Name   string
+	Reason string
+	Status int
+}
+
+// LicenseViolation is a package whose license is not allowed by
+// IPkgMngAllowedLicenses, as returned by LastLicenseViolations
+type LicenseViolation struct {
+	Package string
+	License string
+}
+
+// RemovalImpact is a package removed despite other packages depending on
+// it, as returned by LastRemovalImpacts
+type RemovalImpact struct {
+	Package    string
+	Dependents []string
+}
+
+// Disposition is the full state of a package across the package manager
+// files, as returned by PackageDisposition
+type Disposition struct {
+	Added    bool
+	Removed  bool
+	Held     bool
+	Excluded bool
+	Pending  bool
+}
+
+// PackageInfo is the information about a package provided by the repository
+// API, as returned by GetPackageInfo
+type PackageInfo struct {
+	Name       string `json:"name"`
+	Maintainer string `json:"maintainer"`
+	Origin     string `json:"origin"`
+
+	// InstallTime is the estimated install time in seconds, 0 if unknown
+	InstallTime float64 `json:"installTime"`
+
+	ReverseDependencies []string `json:"reverseDependencies"`
+
+	Version     string `json:"version"`
+	Description string `json:"description"`
+	Checksum    string `json:"checksum"`
+	License     string `json:"license"`
+
+	// Size is the installed size in bytes, 0 if unknown
+	Size int64 `json:"size"`
+
+	Dependencies []string `json:"dependencies"`
+}
+
+// Origin tells who maintains a package and where it comes from, as returned
+// by PackageOrigin. Available is false if the repository API provides
+// neither
+type Origin struct {
+	Maintainer string
+	Origin     string
+	Available  bool
+}
+
+// CommandPlan is what an operation is going to do, as built by
+// BuildCommandPlan
+type CommandPlan struct {
+	Operation ABSystemOperation
+	Add       []string
+	Remove    []string
+	Cmd       string
+}
+
+// ApplyPlan is a preview of everything an operation is going to do, as
+// built by BuildPlan. The hooks are empty if there is nothing to do, since
+// they are then not run either
+type ApplyPlan struct {
+	Operation      ABSystemOperation `json:"operation"`
+	AddPackages    []string          `json:"addPackages"`
+	RemovePackages []string          `json:"removePackages"`
+	PreHook        string            `json:"preHook"`
+	PostHook       string            `json:"postHook"`
+	Cmd            string            `json:"cmd"`
+}
+
+// Summary lists the packages added and removed by the package manager, as
+// returned by GetSummaryStruct and written by WriteSummaryJSON
+type Summary struct {
+	Added        []string `json:"added"`
+	Removed      []string `json:"removed"`
+	AddedCount   int      `json:"addedCount"`
+	RemovedCount int      `json:"removedCount"`
+}
+
+// InstalledChecker tells whether a package is installed in the system
+type InstalledChecker interface {
+	IsInstalled(pkg string) (bool, error)
+}
+
+// RedundantOp is an unstaged operation which would not change the system, as
+// returned by RedundantOperations
+type RedundantOp struct {
+	Package   string
+	Operation string
+	File      string
+	Reason    string
+}
+
+// ErrMalformedRepoResponse is returned when the repository API answers with
+// a body which cannot be parsed. The parsing error is wrapped and can be
+// retrieved with errors.Unwrap
+type ErrMalformedRepoResponse struct {
+	Package string
+	Snippet string
+	Err     error
+}
+
+// repoResponseSnippetLen is the maximum length of the response body
+// reported by ErrMalformedRepoResponse
+const repoResponseSnippetLen = 64
+
+func (e *ErrMalformedRepoResponse) Error() string {
+	return fmt.Sprintf("the repository returned an unexpected response for %s: %q", e.Package, e.Snippet)
+}
+
+func (e *ErrMalformedRepoResponse) Unwrap() error {
+	return e.Err
+}
+
+// ErrPackageNotFound is returned when a package does not exist in the repo.
+// Status is the status code of the repo response, while Reason explains why
+// a response was not accepted, if any. errors.Is matches any
+// ErrPackageNotFound when the target has no package name
+type ErrPackageNotFound struct {
+	Package string
+	Status  int
+	Reason  string
+}
+
+func (e *ErrPackageNotFound) Error() string {
+	if e.Reason != "" {
+		return fmt.Sprintf("package does not exist in repo: %s, %s", e.Package, e.Reason)
+	}
+
+	return fmt.Sprintf("package does not exist in repo: %s", e.Package)
+}
+
+func (e *ErrPackageNotFound) Is(target error) bool {
+	t, ok := target.(*ErrPackageNotFound)
+	return ok && (t.Package == "" || t.Package == e.Package)
+}
+
+// ErrRepoRejected is returned when the repo API refuses a request, because
+// of missing credentials or of rate limiting, instead of telling whether the
+// package exists
+type ErrRepoRejected struct {
+	Package string
+	Status  int
+}
+
+func (e *ErrRepoRejected) Error() string {
+	return fmt.Sprintf("the repo refused the request for %s with status %d, check the iPkgMngApiHeaders setting or try again later", e.Package, e.Status)
+}
+
+// ErrAgreementNotAccepted is returned when the package manager requires the
+// user agreement and it was not accepted
+var ErrAgreementNotAccepted = errors.New("package manager agreement not accepted")
+
 // NewPackageManager returns a new PackageManager struct
 func NewPackageManager(dryRun bool) (*PackageManager, error) {
 	PrintVerboseInfo("PackageManager.NewPackageManager", "running...")
@@ -81,6 +353,14 @@ func NewPackageManager(dryRun bool) (*PackageManager, error) {
 		baseDir = DryRunPackagesBaseDir
 	}
 
+	return NewPackageManagerAt(baseDir, dryRun)
+}
+
+// NewPackageManagerAt returns a new PackageManager struct keeping its files
+// in the given directory, e.g. to work on a profile other than the system one
+func NewPackageManagerAt(baseDir string, dryRun bool) (*PackageManager, error) {
+	PrintVerboseInfo("PackageManager.NewPackageManagerAt", "running...")
+
 	err := os.MkdirAll(baseDir, 0o755)
 	if err != nil {
 		PrintVerboseErr("PackageManager.NewPackageManager", 0, err)
@@ -100,16 +380,33 @@ func NewPackageManager(dryRun bool) (*PackageManager, error) {
 		}
 	}
 
-	_, err = os.Stat(filepath.Join(baseDir, PackagesRemoveFile))
-	if err != nil {
-		err = os.WriteFile(
-			filepath.Join(baseDir, PackagesRemoveFile),
-			[]byte(""),
-			0o644,
-		)
-		if err != nil {
-			PrintVerboseErr("PackageManager.NewPackageManager", 2, err)
-			return nil, err
+	// the removals shipped with the image, if any, are seeded into a missing
+	// or empty packages.remove, so that they are part of the next transaction
+	content, err := os.ReadFile(filepath.Join(baseDir, PackagesRemoveFile))
+	missing := err != nil
+	empty := false
+	if !missing {
+		entries, err := parsePackageEntries(content)
+		empty = err == nil && len(entries) == 0
+	}
+	if missing || empty {
+		removeDefaults, err := os.ReadFile(filepath.Join(baseDir, PackagesRemoveDefaultsFile))
+		if err == nil {
+			PrintVerboseInfo("PackageManager.NewPackageManager", "seeding packages.remove with default removals")
+		} else {
+			removeDefaults = []byte("")
+		}
+
+		if err == nil || missing {
+			err = os.WriteFile(
+				filepath.Join(baseDir, PackagesRemoveFile),
+				removeDefaults,
+				0o644,
+			)
+			if err != nil {
+				PrintVerboseErr("PackageManager.NewPackageManager", 2, err)
+				return nil, err
+			}
 		}
 	}
 
@@ -138,12 +435,49 @@ func NewPackageManager(dryRun bool) (*PackageManager, error) {
 		status = PKG_MNG_DISABLED
 	}
 
-	return &PackageManager{dryRun, baseDir, status}, nil
+	// a misconfigured API would otherwise only be noticed by the first
+	// repo check, which never happens while the package manager is disabled
+	var apiWarning error
+	if status != PKG_MNG_DISABLED {
+		_, err = assertPkgMngApiSetUp()
+		if err != nil {
+			if settings.Cnf.IPkgMngStrictApi {
+				PrintVerboseErr("PackageManager.NewPackageManager", 3.5, err)
+				return nil, err
+			}
+			PrintVerboseWarn("PackageManager.NewPackageManager", 3.5, err)
+			apiWarning = err
+		}
+	}
+
+	pm := &PackageManager{
+		dryRun:      dryRun,
+		baseDir:     baseDir,
+		Status:      status,
+		lockTimeout: DefaultLockTimeout,
+		offline:     settings.Cnf.IPkgMngOffline,
+		apiWarning:  apiWarning,
+	}
+
+	if settings.Cnf.IPkgMngCheckBinaries {
+		for _, err := range pm.CheckBinariesAvailable() {
+			PrintVerboseWarn("PackageManager.NewPackageManager", 4, err)
+		}
+	}
+
+	return pm, nil
 }
 
 // Add adds a package to the packages.add file
 func (p *PackageManager) Add(pkg string) error {
+	return p.AddCtx(context.Background(), pkg)
+}
+
+// AddCtx works like Add but the repo checks are bound to the given context,
+// cancelling it aborts the requests in flight
+func (p *PackageManager) AddCtx(ctx context.Context, pkg string) error {
 	PrintVerboseInfo("PackageManager.Add", "running...")
+	p.trace("add", pkg)
 
 	// Check for package manager status and user agreement
 	err := p.CheckStatus()
@@ -152,6 +486,20 @@ func (p *PackageManager) Add(pkg string) error {
 		return err
 	}
 
+	err = validatePackageName(pkg, true)
+	if err != nil {
+		PrintVerboseErr("PackageManager.Add", 0.05, err)
+		return err
+	}
+	pkg = pinPackageEntry(pkg)
+
+	unlock, err := p.lockForAdd(ctx, pkg)
+	if err != nil {
+		PrintVerboseErr("PackageManager.Add", 0.2, err)
+		return err
+	}
+	defer unlock()
+
 	// Check if package was removed before
 	packageWasRemoved := false
 	removedIndex := -1
@@ -160,32 +508,25 @@ func (p *PackageManager) Add(pkg string) error {
 		PrintVerboseErr("PackageManager.Add", 2.1, err)
 		return err
 	}
+	// version pins are stored with the entry, the package itself is what
+	// the package files and the repo know about
+	pkgName := packageKey(pkg)
 	for i, rp := range pkgsRemove {
-		if rp == pkg {
+		if rp == pkgName {
 			packageWasRemoved = true
 			removedIndex = i
 			break
 		}
 	}
 
-	// packages that have been removed by the user aren't always in the repo
-	if !packageWasRemoved {
-		// Check if package exists in repo
-		for _, _pkg := range strings.Split(pkg, " ") {
-			err := p.ExistsInRepo(_pkg)
-			if err != nil {
-				PrintVerboseErr("PackageManager.Add", 0, err)
-				return err
-			}
-		}
-	}
-
-	// Add to unstaged packages first
 	upkgs, err := p.GetUnstagedPackages()
 	if err != nil {
 		PrintVerboseErr("PackageManager.Add", 1, err)
 		return err
 	}
+
+	// Add to unstaged packages first, a pending removal gets cancelled
+	// by writeUnstagedPackages
 	upkgs = append(upkgs, UnstagedPackage{pkg, ADD})
 	err = p.writeUnstagedPackages(upkgs)
 	if err != nil {
@@ -193,6 +534,12 @@ func (p *PackageManager) Add(pkg string) error {
 		return err
 	}
 
+	err = p.recordChange(ADD, pkg)
+	if err != nil {
+		PrintVerboseErr("PackageManager.Add", 2.2, err)
+		return err
+	}
+
 	// If package was removed by the user, simply remove it from packages.remove
 	// Unstaged will take care of the rest
 	if packageWasRemoved {
@@ -207,11 +554,18 @@ func (p *PackageManager) Add(pkg string) error {
 		PrintVerboseErr("PackageManager.Add", 3, err)
 		return err
 	}
-	for _, p := range pkgsAdd {
-		if p == pkg {
+	for i, ap := range pkgsAdd {
+		if ap == pkg {
 			PrintVerboseInfo("PackageManager.Add", "package already added")
 			return nil
 		}
+
+		// Same package with different options or version, replace its entry
+		if packageKey(ap) == pkgName {
+			pkgsAdd[i] = pkg
+			PrintVerboseInfo("PackageManager.Add", "updating package options")
+			return p.writeAddPackages(pkgsAdd)
+		}
 	}
 
 	pkgsAdd = append(pkgsAdd, pkg)
@@ -220,10 +574,61 @@ func (p *PackageManager) Add(pkg string) error {
 	return p.writeAddPackages(pkgsAdd)
 }
 
+// AddWithReason works like Add but also records why the package is added,
+// as an inline comment of its packages.add entry, so that plain readers of
+// the file are not affected. The reason replaces the previous one, if any,
+// and is only recorded if the package ends up in packages.add, which is not
+// the case for a package removed by the user, see GetAddPackagesDetailed
+func (p *PackageManager) AddWithReason(pkg, reason string) error {
+	PrintVerboseInfo("PackageManager.AddWithReason", "running...")
+
+	err := p.Add(pkg)
+	if err != nil {
+		PrintVerboseErr("PackageManager.AddWithReason", 0, err)
+		return err
+	}
+
+	// a reason spans a single line, the comment would end otherwise
+	reason = strings.Join(strings.Fields(reason), " ")
+	if reason == "" {
+		return nil
+	}
+
+	unlock, err := p.lock()
+	if err != nil {
+		PrintVerboseErr("PackageManager.AddWithReason", 1, err)
+		return err
+	}
+	defer unlock()
+
+	pkgsAdd, err := p.GetAddPackages()
+	if err != nil {
+		PrintVerboseErr("PackageManager.AddWithReason", 2, err)
+		return err
+	}
+	key := packageKey(pinPackageEntry(pkg))
+	if !slices.ContainsFunc(pkgsAdd, func(ap string) bool { return packageKey(ap) == key }) {
+		PrintVerboseInfo("PackageManager.AddWithReason", "package not in packages.add, the reason is not recorded")
+		return nil
+	}
+
+	comments := p.readPackageComments(PackagesAddFile)
+	comments.inline[key] = "# " + reason
+
+	err = p.writePackagesCommented(PackagesAddFile, pkgsAdd, comments)
+	if err != nil {
+		PrintVerboseErr("PackageManager.AddWithReason", 3, err)
+		return err
+	}
+
+	return nil
+}
+
 // Remove either removes a manually added package from packages.add or adds
 // a package to be deleted into packages.remove
 func (p *PackageManager) Remove(pkg string) error {
 	PrintVerboseInfo("PackageManager.Remove", "running...")
+	p.trace("remove", pkg)
 
 	// Check for package manager status and user agreement
 	err := p.CheckStatus()
@@ -232,15 +637,37 @@ func (p *PackageManager) Remove(pkg string) error {
 		return err
 	}
 
-	// Check if package exists in repo
-	// FIXME: this should also check if the package is actually installed
-	// in the system, not just if it exists in the repo. Since this is a distro
-	// specific feature, I'm leaving it as is for now.
-	err = p.ExistsInRepo(pkg)
+	err = validatePackageName(pkg, false)
+	if err != nil {
+		PrintVerboseErr("PackageManager.Remove", 0.05, err)
+		return err
+	}
+	// a version pin makes no sense for a removal
+	pkg = packageKey(pkg)
+
+	// Check if package exists in repo, before taking the lock so that a
+	// slow repo does not hold back the other writers
+	err = p.validateInRepo(context.Background(), pkg)
 	if err != nil {
 		PrintVerboseErr("PackageManager.Remove", 1, err)
 		return err
 	}
+	p.setLastRemovalImpacts(p.removalImpacts(pkg))
+
+	unlock, err := p.lock()
+	if err != nil {
+		PrintVerboseErr("PackageManager.Remove", 0.2, err)
+		return err
+	}
+	defer unlock()
+
+	// Check if package is installed, this is opt-in since telling which
+	// packages are installed is distro specific
+	err = p.checkInstalled(pkg)
+	if err != nil {
+		PrintVerboseErr("PackageManager.Remove", 1.2, err)
+		return err
+	}
 
 	// Add to unstaged packages first
 	upkgs, err := p.GetUnstagedPackages()
@@ -255,6 +682,19 @@ func (p *PackageManager) Remove(pkg string) error {
 		return err
 	}
 
+	err = p.recordChange(REMOVE, pkg)
+	if err != nil {
+		PrintVerboseErr("PackageManager.Remove", 3.2, err)
+		return err
+	}
+
+	// A removed package cannot be held anymore
+	err = p.dropHold(pkg)
+	if err != nil {
+		PrintVerboseErr("PackageManager.Remove", 3.1, err)
+		return err
+	}
+
 	// If package was added by the user, simply remove it from packages.add
 	// Unstaged will take care of the rest
 	pkgsAdd, err := p.GetAddPackages()
@@ -263,7 +703,7 @@ func (p *PackageManager) Remove(pkg string) error {
 		return err
 	}
 	for i, ap := range pkgsAdd {
-		if ap == pkg {
+		if packageKey(ap) == pkg {
 			pkgsAdd = append(pkgsAdd[:i], pkgsAdd[i+1:]...)
 			PrintVerboseInfo("PackageManager.Remove", "removing manually added package")
 			return p.writeAddPackages(pkgsAdd)
@@ -290,437 +730,3251 @@ func (p *PackageManager) Remove(pkg string) error {
 	return p.writeRemovePackages(pkgsRemove)
 }
 
-// GetAddPackages returns the packages in the packages.add file
-func (p *PackageManager) GetAddPackages() ([]string, error) {
-	PrintVerboseInfo("PackageManager.GetAddPackages", "running...")
-	return p.getPackages(PackagesAddFile)
+// ReplaceAddPackages replaces the whole packages.add file with the given
+// packages. The new packages are checked in the repo first, then the
+// differences against the current list are staged, so that the next apply
+// installs the new packages and removes the dropped ones. Duplicates are
+// dropped while the order of the list is preserved, use
+// ReplaceAddPackagesSorted for a sorted file
+func (p *PackageManager) ReplaceAddPackages(pkgs []string) error {
+	PrintVerboseInfo("PackageManager.ReplaceAddPackages", "running...")
+	return p.replaceAddPackages(pkgs, true)
 }
 
-// GetRemovePackages returns the packages in the packages.remove file
-func (p *PackageManager) GetRemovePackages() ([]string, error) {
-	PrintVerboseInfo("PackageManager.GetRemovePackages", "running...")
-	return p.getPackages(PackagesRemoveFile)
+// ReplaceAddPackagesSorted works like ReplaceAddPackages but writes the
+// packages sorted by name, version pins aside
+func (p *PackageManager) ReplaceAddPackagesSorted(pkgs []string) error {
+	PrintVerboseInfo("PackageManager.ReplaceAddPackagesSorted", "running...")
+
+	sorted := slices.Clone(pkgs)
+	slices.SortStableFunc(sorted, func(a, b string) int {
+		return strings.Compare(packageKey(strings.TrimSpace(a)), packageKey(strings.TrimSpace(b)))
+	})
+
+	return p.replaceAddPackages(sorted, true)
 }
 
-// GetUnstagedPackages returns the package changes that are yet to be applied
-func (p *PackageManager) GetUnstagedPackages() ([]UnstagedPackage, error) {
-	PrintVerboseInfo("PackageManager.GetUnstagedPackages", "running...")
-	pkgs, err := p.getPackages(PackagesUnstagedFile)
+// replaceAddPackages implements ReplaceAddPackages, the repo checks are
+// skipped if validate is false, for callers checking the packages themselves
+func (p *PackageManager) replaceAddPackages(pkgs []string, validate bool) error {
+	err := p.CheckStatus()
 	if err != nil {
-		PrintVerboseErr("PackageManager.GetUnstagedPackages", 0, err)
-		return nil, err
+		PrintVerboseErr("PackageManager.ReplaceAddPackages", 0, err)
+		return err
 	}
 
-	unstagedList := []UnstagedPackage{}
-	for _, line := range pkgs {
-		if line == "" || line == "\n" {
+	for _, pkg := range pkgs {
+		pkg = strings.TrimSpace(pkg)
+		if pkg == "" {
 			continue
 		}
-
-		splits := strings.SplitN(line, " ", 2)
-		unstagedList = append(unstagedList, UnstagedPackage{splits[1], splits[0]})
+		err = validatePackageName(pkg, true)
+		if err != nil {
+			PrintVerboseErr("PackageManager.ReplaceAddPackages", 0.05, err)
+			return err
+		}
 	}
 
-	return unstagedList, nil
-}
-
-// GetUnstagedPackagesPlain returns the package changes that are yet to be applied
-// as strings
-func (p *PackageManager) GetUnstagedPackagesPlain() ([]string, error) {
-	PrintVerboseInfo("PackageManager.GetUnstagedPackagesPlain", "running...")
-	pkgs, err := p.GetUnstagedPackages()
+	unlock, err := p.lock()
 	if err != nil {
-		PrintVerboseErr("PackageManager.GetUnstagedPackagesPlain", 0, err)
-		return nil, err
+		PrintVerboseErr("PackageManager.ReplaceAddPackages", 0.5, err)
+		return err
 	}
+	defer unlock()
 
-	unstagedList := []string{}
+	newPkgs := []string{}
 	for _, pkg := range pkgs {
-		unstagedList = append(unstagedList, pkg.Name)
+		pkg = strings.TrimSpace(pkg)
+		if pkg != "" && !slices.Contains(newPkgs, pkg) {
+			newPkgs = append(newPkgs, pkg)
+		}
 	}
 
-	return unstagedList, nil
-}
-
-// ClearUnstagedPackages removes all packages from the unstaged list
-func (p *PackageManager) ClearUnstagedPackages() error {
-	PrintVerboseInfo("PackageManager.ClearUnstagedPackages", "running...")
-	return p.writeUnstagedPackages([]UnstagedPackage{})
-}
-
-// GetAddPackagesString returns the packages in the packages.add file as a string
-func (p *PackageManager) GetAddPackagesString(sep string) (string, error) {
-	PrintVerboseInfo("PackageManager.GetAddPackagesString", "running...")
-	pkgs, err := p.GetAddPackages()
+	oldPkgs, err := p.GetAddPackages()
 	if err != nil {
-		PrintVerboseErr("PackageManager.GetAddPackagesString", 0, err)
-		return "", err
+		PrintVerboseErr("PackageManager.ReplaceAddPackages", 1, err)
+		return err
 	}
-
-	PrintVerboseInfo("PackageManager.GetAddPackagesString", "done")
-	return strings.Join(pkgs, sep), nil
-}
-
-// GetRemovePackagesString returns the packages in the packages.remove file as a string
-func (p *PackageManager) GetRemovePackagesString(sep string) (string, error) {
-	PrintVerboseInfo("PackageManager.GetRemovePackagesString", "running...")
-	pkgs, err := p.GetRemovePackages()
+	pkgsRemove, err := p.GetRemovePackages()
 	if err != nil {
-		PrintVerboseErr("PackageManager.GetRemovePackagesString", 0, err)
-		return "", err
+		PrintVerboseErr("PackageManager.ReplaceAddPackages", 2, err)
+		return err
 	}
 
-	PrintVerboseInfo("PackageManager.GetRemovePackagesString", "done")
-	return strings.Join(pkgs, sep), nil
-}
-
-func (p *PackageManager) getPackages(file string) ([]string, error) {
-	PrintVerboseInfo("PackageManager.getPackages", "running...")
-
-	pkgs := []string{}
-	f, err := os.Open(filepath.Join(p.baseDir, file))
-	if err != nil {
-		PrintVerboseErr("PackageManager.getPackages", 0, err)
-		return pkgs, err
+	// entries are matched by package, so that a package pinned to another
+	// version is staged as a single addition of the new pin
+	oldKeys := map[string]bool{}
+	for _, pkg := range oldPkgs {
+		oldKeys[packageKey(pkg)] = true
+	}
+	newKeys := map[string]bool{}
+	for _, pkg := range newPkgs {
+		newKeys[packageKey(pkg)] = true
 	}
-	defer f.Close()
 
-	b, err := io.ReadAll(f)
+	// packages that have been removed by the user aren't always in the
+	// repo, as in Add they are simply unset from packages.remove
+	toCheck := []string{}
+	for _, pkg := range newPkgs {
+		if !oldKeys[packageKey(pkg)] && !slices.Contains(pkgsRemove, packageKey(pkg)) {
+			toCheck = append(toCheck, strings.Split(packageKey(pkg), " ")...)
+		}
+	}
+	if validate {
+		err = p.validateInRepo(withRetryBudget(context.Background()), toCheck...)
+		if err != nil {
+			PrintVerboseErr("PackageManager.ReplaceAddPackages", 3, err)
+			return err
+		}
+	}
+
+	upkgs, err := p.GetUnstagedPackages()
 	if err != nil {
-		PrintVerboseErr("PackageManager.getPackages", 1, err)
-		return pkgs, err
+		PrintVerboseErr("PackageManager.ReplaceAddPackages", 4, err)
+		return err
+	}
+	for _, pkg := range newPkgs {
+		if !slices.Contains(oldPkgs, pkg) {
+			upkgs = append(upkgs, UnstagedPackage{pkg, ADD})
+		}
+	}
+	for _, pkg := range oldPkgs {
+		if pkg != "" && !newKeys[packageKey(pkg)] {
+			upkgs = append(upkgs, UnstagedPackage{pkg, REMOVE})
+		}
+	}
+	err = p.writeUnstagedPackages(upkgs)
+	if err != nil {
+		PrintVerboseErr("PackageManager.ReplaceAddPackages", 5, err)
+		return err
 	}
 
-	pkgs = strings.Split(strings.TrimSpace(string(b)), "\n")
+	keptRemove := []string{}
+	for _, pkg := range pkgsRemove {
+		if !newKeys[packageKey(pkg)] {
+			keptRemove = append(keptRemove, pkg)
+		}
+	}
+	if len(keptRemove) != len(pkgsRemove) {
+		PrintVerboseInfo("PackageManager.ReplaceAddPackages", "unsetting manually removed packages")
+		err = p.writeRemovePackages(keptRemove)
+		if err != nil {
+			PrintVerboseErr("PackageManager.ReplaceAddPackages", 6, err)
+			return err
+		}
+	}
 
-	PrintVerboseInfo("PackageManager.getPackages", "returning packages")
-	return pkgs, nil
+	PrintVerboseInfo("PackageManager.ReplaceAddPackages", "writing packages.add")
+	return p.writeAddPackages(newPkgs)
 }
 
-func (p *PackageManager) writeAddPackages(pkgs []string) error {
-	PrintVerboseInfo("PackageManager.writeAddPackages", "running...")
-	return p.writePackages(PackagesAddFile, pkgs)
+// RemoveWithOrphans works like Remove but also removes the dependencies of
+// the package which were manually added and are not required by any other
+// manually added package. It returns the list of removed orphans.
+//
+// Only packages listed in packages.add are considered, dependencies shipped
+// with the image are left untouched since removing them could break the
+// base system
+func (p *PackageManager) RemoveWithOrphans(pkg string) ([]string, error) {
+	PrintVerboseInfo("PackageManager.RemoveWithOrphans", "running...")
+
+	deps, err := p.ResolveDependencies(pkg)
+	if err != nil {
+		PrintVerboseErr("PackageManager.RemoveWithOrphans", 0, err)
+		return nil, err
+	}
+
+	err = p.Remove(pkg)
+	if err != nil {
+		PrintVerboseErr("PackageManager.RemoveWithOrphans", 1, err)
+		return nil, err
+	}
+
+	pkgsAdd, err := p.GetAddPackages()
+	if err != nil {
+		PrintVerboseErr("PackageManager.RemoveWithOrphans", 2, err)
+		return nil, err
+	}
+
+	// collect what the remaining packages still need, orphans are the
+	// dependencies which were added manually but are not needed anymore
+	required := map[string]bool{}
+	added := map[string]bool{}
+	for _, entry := range pkgsAdd {
+		for _, name := range strings.Fields(entry) {
+			added[name] = true
+		}
+	}
+	for name := range added {
+		otherDeps, err := p.ResolveDependencies(name)
+		if err != nil {
+			PrintVerboseErr("PackageManager.RemoveWithOrphans", 3, err)
+			return nil, err
+		}
+		for _, dep := range otherDeps {
+			required[dep] = true
+		}
+	}
+
+	orphans := []string{}
+	for _, dep := range deps {
+		if dep == pkg || !added[dep] || required[dep] {
+			continue
+		}
+
+		PrintVerboseInfo("PackageManager.RemoveWithOrphans", "removing orphaned dependency", dep)
+		err = p.Remove(dep)
+		if err != nil {
+			PrintVerboseErr("PackageManager.RemoveWithOrphans", 4, err)
+			return orphans, err
+		}
+		orphans = append(orphans, dep)
+	}
+
+	return orphans, nil
 }
 
-func (p *PackageManager) writeRemovePackages(pkgs []string) error {
-	PrintVerboseInfo("PackageManager.writeRemovePackages", "running...")
-	return p.writePackages(PackagesRemoveFile, pkgs)
+// ResolveDependencies returns the dependency closure of a package, as
+// reported by the repository API. Packages the API has no dependency data
+// for are considered to have no dependencies
+func (p *PackageManager) ResolveDependencies(pkg string) ([]string, error) {
+	PrintVerboseInfo("PackageManager.ResolveDependencies", "running...")
+
+	deps := []string{}
+	seen := map[string]bool{pkg: true}
+	queue := []string{pkg}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+
+		pkgInfo := map[string]interface{}{}
+		err := fetchRepoContents(context.Background(), p.client(), current, &pkgInfo)
+		if err != nil {
+			PrintVerboseErr("PackageManager.ResolveDependencies", 0, err)
+			return nil, err
+		}
+
+		rawDeps, ok := pkgInfo["dependencies"].([]interface{})
+		if !ok {
+			continue
+		}
+
+		for _, rawDep := range rawDeps {
+			dep, ok := rawDep.(string)
+			if !ok {
+				continue
+			}
+
+			// strip version constraints and alternatives, e.g.
+			// "libc6 (>= 2.34)" or "default-mta | mail-transport-agent"
+			dep = strings.TrimSpace(strings.Split(dep, "|")[0])
+			dep = strings.Split(dep, " ")[0]
+			if dep == "" || seen[dep] {
+				continue
+			}
+
+			seen[dep] = true
+			deps = append(deps, dep)
+			queue = append(queue, dep)
+		}
+	}
+
+	return deps, nil
 }
 
-func (p *PackageManager) writeUnstagedPackages(pkgs []UnstagedPackage) error {
-	PrintVerboseInfo("PackageManager.writeUnstagedPackages", "running...")
+// ReverseDependencies returns the packages depending on the given one, as
+// reported by the repository API. The list is empty if the API does not
+// provide reverse dependencies
+func (p *PackageManager) ReverseDependencies(pkg string) ([]string, error) {
+	PrintVerboseInfo("PackageManager.ReverseDependencies", "running...")
+
+	pkgInfo, err := p.GetPackageInfo(pkg)
+	if err != nil {
+		PrintVerboseErr("PackageManager.ReverseDependencies", 0, err)
+		return nil, err
+	}
+
+	rdeps := []string{}
+	for _, rdep := range pkgInfo.ReverseDependencies {
+		// strip version constraints, as in ResolveDependencies
+		rdep = strings.Split(strings.TrimSpace(rdep), " ")[0]
+		if rdep != "" {
+			rdeps = append(rdeps, rdep)
+		}
+	}
+
+	return rdeps, nil
+}
+
+// LicenseAllowed reports whether a license matches one of the globs in
+// IPkgMngAllowedLicenses, every license is allowed if none is set
+func LicenseAllowed(license string) bool {
+	if len(settings.Cnf.IPkgMngAllowedLicenses) == 0 {
+		return true
+	}
+
+	for _, pattern := range settings.Cnf.IPkgMngAllowedLicenses {
+		matched, err := filepath.Match(pattern, license)
+		if err == nil && matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkLicenses warns about the packages whose license is not allowed,
+// returning them, or refuses them if IPkgMngStrictLicenses is set. Packages
+// the repo reports no license for are not checked, unless in strict mode
+// where they are refused as for a failed license lookup, so that the check
+// cannot be bypassed
+func (p *PackageManager) checkLicenses(ctx context.Context, pkgs ...string) ([]LicenseViolation, error) {
+	violations := []LicenseViolation{}
+	if len(settings.Cnf.IPkgMngAllowedLicenses) == 0 || p.validationSuspended {
+		return violations, nil
+	}
 
-	// create slice without redundant entries
-	pkgsCleaned := []UnstagedPackage{}
 	for _, pkg := range pkgs {
-		isDuplicate := false
-		for iCmp, pkgCmp := range pkgsCleaned {
-			if pkg.Name == pkgCmp.Name {
-				isDuplicate = true
+		pkgInfo, err := p.getPackageInfo(ctx, pkg)
+		if err != nil {
+			// a cancelled lookup aborts the whole operation
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if settings.Cnf.IPkgMngStrictLicenses {
+				return nil, fmt.Errorf("cannot check the license of %s: %w", pkg, err)
+			}
+			PrintVerboseWarn("PackageManager.checkLicenses", 0, "cannot check the license of", pkg, err)
+			continue
+		}
+		if pkgInfo.License == "" {
+			if settings.Cnf.IPkgMngStrictLicenses {
+				return nil, fmt.Errorf("cannot check the license of %s: the repo reports no license", pkg)
+			}
+			continue
+		}
+		if LicenseAllowed(pkgInfo.License) {
+			continue
+		}
 
-				// remove complement (+ then - or - then +)
-				if pkg.Status != pkgCmp.Status {
-					pkgsCleaned = append(pkgsCleaned[:iCmp], pkgsCleaned[iCmp+1:]...)
+		if settings.Cnf.IPkgMngStrictLicenses {
+			return nil, fmt.Errorf("package %s has a license which is not allowed: %s", pkg, pkgInfo.License)
+		}
+		PrintVerboseWarn("PackageManager.checkLicenses", 1, "package", pkg, "has a license which is not allowed:", pkgInfo.License)
+		violations = append(violations, LicenseViolation{pkg, pkgInfo.License})
+	}
+
+	return violations, nil
+}
+
+// setLastLicenseViolations records the packages the last Add or AddMany
+// warned about, see LastLicenseViolations
+func (p *PackageManager) setLastLicenseViolations(violations []LicenseViolation) {
+	p.resultsMutex.Lock()
+	defer p.resultsMutex.Unlock()
+	p.lastLicenseViolations = violations
+}
+
+// LastLicenseViolations returns the packages added by the last Add or
+// AddMany despite having a license which is not allowed, which only happens
+// if IPkgMngStrictLicenses is not set. This is only kept in memory
+func (p *PackageManager) LastLicenseViolations() []LicenseViolation {
+	PrintVerboseInfo("PackageManager.LastLicenseViolations", "running...")
+
+	p.resultsMutex.Lock()
+	defer p.resultsMutex.Unlock()
+	return p.lastLicenseViolations
+}
+
+// removalImpacts returns the given packages which other packages depend on,
+// see RemovalDependents. This is best effort since not every repo provides
+// reverse dependencies, so the failed lookups are only logged
+func (p *PackageManager) removalImpacts(pkgs ...string) []RemovalImpact {
+	impacts := []RemovalImpact{}
+	if p.validationSuspended || p.offline {
+		return impacts
+	}
+
+	for _, pkg := range pkgs {
+		dependents, err := p.RemovalDependents(pkg)
+		if err != nil {
+			PrintVerboseWarn("PackageManager.removalImpacts", 0, "cannot look up the packages depending on", pkg, err)
+			continue
+		}
+		if len(dependents) > 0 {
+			PrintVerboseWarn("PackageManager.removalImpacts", 1, "removing", pkg, "affects the packages depending on it:", strings.Join(dependents, ", "))
+			impacts = append(impacts, RemovalImpact{pkg, dependents})
+		}
+	}
+
+	return impacts
+}
+
+// setLastRemovalImpacts records the packages the last Remove or RemoveMany
+// warned about, see LastRemovalImpacts
+func (p *PackageManager) setLastRemovalImpacts(impacts []RemovalImpact) {
+	p.resultsMutex.Lock()
+	defer p.resultsMutex.Unlock()
+	p.lastRemovalImpacts = impacts
+}
+
+// LastRemovalImpacts returns the packages removed by the last Remove or
+// RemoveMany along with the installed packages depending on them, so that
+// callers can warn about them. This is only kept in memory
+func (p *PackageManager) LastRemovalImpacts() []RemovalImpact {
+	PrintVerboseInfo("PackageManager.LastRemovalImpacts", "running...")
+
+	p.resultsMutex.Lock()
+	defer p.resultsMutex.Unlock()
+	return p.lastRemovalImpacts
+}
+
+// RemovalDependents returns the reverse dependencies of a package which are
+// installed, according to the installed checker, or added by the user when
+// no checker is set. Removing the package would affect them, Remove and
+// RemoveMany report them through LastRemovalImpacts
+func (p *PackageManager) RemovalDependents(pkg string) ([]string, error) {
+	PrintVerboseInfo("PackageManager.RemovalDependents", "running...")
+
+	rdeps, err := p.ReverseDependencies(pkg)
+	if err != nil {
+		PrintVerboseErr("PackageManager.RemovalDependents", 0, err)
+		return nil, err
+	}
+
+	pkgsAdd, err := p.GetAddPackages()
+	if err != nil {
+		PrintVerboseErr("PackageManager.RemovalDependents", 1, err)
+		return nil, err
+	}
+
+	dependents := []string{}
+	for _, rdep := range rdeps {
+		installed := containsPackage(pkgsAdd, rdep)
+		if p.installedChecker != nil {
+			installed, err = p.installedChecker.IsInstalled(rdep)
+			if err != nil {
+				PrintVerboseErr("PackageManager.RemovalDependents", 2, err)
+				return nil, err
+			}
+		}
+
+		if installed {
+			dependents = append(dependents, rdep)
+		}
+	}
+
+	return dependents, nil
+}
+
+// InstallOrder returns the packages in the packages.add file sorted so that
+// each package comes after the added packages it depends on. The file order
+// is kept between independent packages, and it is returned as is when the
+// dependency data is unavailable
+func (p *PackageManager) InstallOrder() ([]string, error) {
+	PrintVerboseInfo("PackageManager.InstallOrder", "running...")
+
+	pkgs, err := p.GetAddPackages()
+	if err != nil {
+		PrintVerboseErr("PackageManager.InstallOrder", 0, err)
+		return nil, err
+	}
+
+	entries := []string{}
+	for _, pkg := range pkgs {
+		if pkg != "" {
+			entries = append(entries, pkg)
+		}
+	}
+
+	return p.orderByDeps(entries), nil
+}
+
+// orderByDeps topologically sorts the given package entries by their
+// dependencies, falling back to the given order if the dependencies cannot
+// be resolved. Packages in a dependency cycle are left in the given order
+func (p *PackageManager) orderByDeps(entries []string) []string {
+	// requires[i] lists the entries entry i depends on
+	requires := make([][]int, len(entries))
+	for i, entry := range entries {
+		names, _ := splitPackageOptions(entry)
+
+		closure := map[string]bool{}
+		for _, name := range strings.Fields(names) {
+			deps, err := p.ResolveDependencies(name)
+			if err != nil {
+				PrintVerboseWarn("PackageManager.orderByDeps", 0, "dependency data unavailable, keeping the file order:", err)
+				return entries
+			}
+			for _, dep := range deps {
+				closure[dep] = true
+			}
+		}
+
+		for j, other := range entries {
+			otherNames, _ := splitPackageOptions(other)
+			for _, name := range strings.Fields(otherNames) {
+				if i != j && closure[name] {
+					requires[i] = append(requires[i], j)
+					break
 				}
+			}
+		}
+	}
+
+	ordered := []string{}
+	placed := make([]bool, len(entries))
+	for len(ordered) < len(entries) {
+		progress := false
+		for i, entry := range entries {
+			if placed[i] {
+				continue
+			}
 
+			ready := true
+			for _, j := range requires[i] {
+				if !placed[j] {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				ordered = append(ordered, entry)
+				placed[i] = true
+				progress = true
 				break
 			}
 		}
 
-		// don't add duplicate
-		if !isDuplicate {
-			pkgsCleaned = append(pkgsCleaned, pkg)
+		// a cycle, place the remaining entries as they are
+		if !progress {
+			for i, entry := range entries {
+				if !placed[i] {
+					ordered = append(ordered, entry)
+					placed[i] = true
+				}
+			}
 		}
 	}
 
-	pkgFmt := []string{}
-	for _, pkg := range pkgsCleaned {
-		pkgFmt = append(pkgFmt, fmt.Sprintf("%s %s", pkg.Status, pkg.Name))
+	return ordered
+}
+
+// GetAddPackages returns the packages in the packages.add file
+func (p *PackageManager) GetAddPackages() ([]string, error) {
+	PrintVerboseInfo("PackageManager.GetAddPackages", "running...")
+	return p.getPackages(PackagesAddFile)
+}
+
+// PackageEntry is an entry of the packages.add file along with the reason it
+// was added for, if any, see AddWithReason
+type PackageEntry struct {
+	Name   string
+	Reason string
+}
+
+// GetAddPackagesDetailed returns the packages in the packages.add file along
+// with their reasons, taken from their inline comments
+func (p *PackageManager) GetAddPackagesDetailed() ([]PackageEntry, error) {
+	PrintVerboseInfo("PackageManager.GetAddPackagesDetailed", "running...")
+
+	pkgs, err := p.GetAddPackages()
+	if err != nil {
+		PrintVerboseErr("PackageManager.GetAddPackagesDetailed", 0, err)
+		return nil, err
 	}
 
-	return p.writePackages(PackagesUnstagedFile, pkgFmt)
+	comments := p.readPackageComments(PackagesAddFile)
+	entries := []PackageEntry{}
+	for _, pkg := range pkgs {
+		reason := strings.TrimSpace(strings.TrimPrefix(comments.inline[packageKey(pkg)], "#"))
+		entries = append(entries, PackageEntry{pkg, reason})
+	}
+
+	return entries, nil
 }
 
-func (p *PackageManager) writePackages(file string, pkgs []string) error {
-	PrintVerboseInfo("PackageManager.writePackages", "running...")
+// GetRemovePackages returns the packages in the packages.remove file
+func (p *PackageManager) GetRemovePackages() ([]string, error) {
+	PrintVerboseInfo("PackageManager.GetRemovePackages", "running...")
+	return p.getPackages(PackagesRemoveFile)
+}
 
-	f, err := os.Create(filepath.Join(p.baseDir, file))
+// Hold adds a package to the packages.hold file. Holds only concern the
+// packages.hold file, the package is neither added nor removed
+func (p *PackageManager) Hold(pkg string) error {
+	PrintVerboseInfo("PackageManager.Hold", "running...")
+
+	err := p.CheckStatus()
 	if err != nil {
-		PrintVerboseErr("PackageManager.writePackages", 0, err)
+		PrintVerboseErr("PackageManager.Hold", 0, err)
 		return err
 	}
-	defer f.Close()
 
+	err = validatePackageName(pkg, false)
+	if err != nil {
+		PrintVerboseErr("PackageManager.Hold", 0.05, err)
+		return err
+	}
+
+	unlock, err := p.lock()
+	if err != nil {
+		PrintVerboseErr("PackageManager.Hold", 0.5, err)
+		return err
+	}
+	defer unlock()
+
+	held, err := p.GetHeldPackages()
+	if err != nil {
+		PrintVerboseErr("PackageManager.Hold", 1, err)
+		return err
+	}
+	if slices.Contains(held, pkg) {
+		PrintVerboseInfo("PackageManager.Hold", "package already held")
+		return nil
+	}
+
+	PrintVerboseInfo("PackageManager.Hold", "writing packages.hold")
+	return p.writePackages(PackagesHoldFile, append(held, pkg))
+}
+
+// Unhold removes a package from the packages.hold file, leaving the other
+// package files untouched
+func (p *PackageManager) Unhold(pkg string) error {
+	PrintVerboseInfo("PackageManager.Unhold", "running...")
+
+	err := p.CheckStatus()
+	if err != nil {
+		PrintVerboseErr("PackageManager.Unhold", 0, err)
+		return err
+	}
+
+	unlock, err := p.lock()
+	if err != nil {
+		PrintVerboseErr("PackageManager.Unhold", 0.5, err)
+		return err
+	}
+	defer unlock()
+
+	return p.dropHold(pkg)
+}
+
+// GetHeldPackages returns the packages in the packages.hold file
+func (p *PackageManager) GetHeldPackages() ([]string, error) {
+	PrintVerboseInfo("PackageManager.GetHeldPackages", "running...")
+
+	pkgs, err := p.getPackagesIfExists(PackagesHoldFile)
+	if err != nil {
+		PrintVerboseErr("PackageManager.GetHeldPackages", 0, err)
+		return nil, err
+	}
+
+	held := []string{}
 	for _, pkg := range pkgs {
-		if pkg == "" {
-			continue
+		if pkg != "" {
+			held = append(held, pkg)
 		}
+	}
+
+	return held, nil
+}
+
+// dropHold removes the hold entry of a package, if any. The caller must hold
+// the package files lock
+func (p *PackageManager) dropHold(pkg string) error {
+	held, err := p.GetHeldPackages()
+	if err != nil {
+		return err
+	}
+
+	i := slices.Index(held, pkg)
+	if i == -1 {
+		return nil
+	}
+
+	PrintVerboseInfo("PackageManager.dropHold", "releasing hold on "+pkg)
+	return p.writePackages(PackagesHoldFile, slices.Delete(held, i, i+1))
+}
+
+// SetInstalledChecker sets the checker used to tell which packages are
+// installed in the system
+func (p *PackageManager) SetInstalledChecker(checker InstalledChecker) {
+	p.installedChecker = checker
+}
+
+// ErrPackageNotInstalled is returned by Remove and RemoveMany for a package
+// which is not installed, if iPkgMngCheckInstalled is set
+var ErrPackageNotInstalled = errors.New("package not installed")
+
+// checkInstalled returns an error wrapping ErrPackageNotInstalled for the
+// first package which is not installed according to the installed checker,
+// packages added by the user and yet to be installed aside. It does nothing
+// unless iPkgMngCheckInstalled is set along with an installed checker
+func (p *PackageManager) checkInstalled(pkgs ...string) error {
+	if !settings.Cnf.IPkgMngCheckInstalled || p.installedChecker == nil {
+		return nil
+	}
+
+	for _, pkg := range pkgs {
+		installed, err := p.installedChecker.IsInstalled(pkg)
+		if err != nil {
+			return err
+		}
+		if installed {
+			continue
+		}
+
+		state, err := p.GetPackageState(pkg)
+		if err != nil {
+			return err
+		}
+		if state != ADD {
+			return fmt.Errorf("%w: %s", ErrPackageNotInstalled, pkg)
+		}
+	}
+
+	return nil
+}
+
+// RedundantOperations returns the unstaged operations which would not change
+// the system: additions of packages which are already installed and removals
+// of packages which are not. Committed operations are not reported, since
+// they are re-applied on every new image and must be kept for the next
+// upgrades, whatever the current state of the system. An installed checker
+// must be set with SetInstalledChecker
+func (p *PackageManager) RedundantOperations() ([]RedundantOp, error) {
+	PrintVerboseInfo("PackageManager.RedundantOperations", "running...")
+
+	if p.installedChecker == nil {
+		err := errors.New("no installed checker set, cannot tell which packages are installed")
+		PrintVerboseErr("PackageManager.RedundantOperations", 0, err)
+		return nil, err
+	}
+
+	upkgs, err := p.GetUnstagedPackages()
+	if err != nil {
+		PrintVerboseErr("PackageManager.RedundantOperations", 1, err)
+		return nil, err
+	}
+	redundant := []RedundantOp{}
+	for _, upkg := range upkgs {
+		// version pins are not known to the installed checker
+		for _, name := range strings.Fields(packageKey(upkg.Name)) {
+			installed, err := p.installedChecker.IsInstalled(name)
+			if err != nil {
+				PrintVerboseErr("PackageManager.RedundantOperations", 2, err)
+				return nil, err
+			}
+
+			switch {
+			case upkg.Status == ADD && installed:
+				redundant = append(redundant, RedundantOp{name, upkg.Status, PackagesUnstagedFile, "package is already installed"})
+			case upkg.Status == REMOVE && !installed:
+				redundant = append(redundant, RedundantOp{name, upkg.Status, PackagesUnstagedFile, "package is not installed"})
+			}
+		}
+	}
+
+	return redundant, nil
+}
+
+// CompactAppliedRemovals drops from the packages.remove file the packages
+// the installed checker confirms absent from the system, since their removal
+// has taken effect, and returns them. Nothing is changed if any check fails.
+// Beware that packages.remove is re-applied on every new image, so a
+// compacted package comes back with the next upgrade if the image ships it;
+// see CompactRemovalsForImage for a compaction which is safe upon upgrades
+func (p *PackageManager) CompactAppliedRemovals() ([]string, error) {
+	PrintVerboseInfo("PackageManager.CompactAppliedRemovals", "running...")
+
+	if p.installedChecker == nil {
+		err := errors.New("no installed checker set, cannot tell which removals have taken effect")
+		PrintVerboseErr("PackageManager.CompactAppliedRemovals", 0, err)
+		return nil, err
+	}
+
+	return p.compactRemovals(func(pkg string) (bool, error) {
+		installed, err := p.installedChecker.IsInstalled(pkg)
+		if err != nil {
+			return false, fmt.Errorf("cannot check if %s is installed, nothing was compacted: %w", pkg, err)
+		}
+		return !installed, nil
+	})
+}
+
+// CompactRemovalsForImage drops from the packages.remove file the packages
+// which are not part of the given package list of the incoming image, and
+// returns them. Unlike CompactAppliedRemovals, the compacted packages don't
+// come back with the upgrade, since the image does not ship them
+func (p *PackageManager) CompactRemovalsForImage(imagePkgs []string) ([]string, error) {
+	PrintVerboseInfo("PackageManager.CompactRemovalsForImage", "running...")
+
+	shipped := map[string]bool{}
+	for _, pkg := range imagePkgs {
+		shipped[strings.TrimSpace(pkg)] = true
+	}
+
+	return p.compactRemovals(func(pkg string) (bool, error) {
+		return !shipped[pkg], nil
+	})
+}
+
+// compactRemovals drops from the packages.remove file the packages for which
+// compactable returns true, and returns them. Nothing is changed if it fails
+// for any package
+func (p *PackageManager) compactRemovals(compactable func(pkg string) (bool, error)) ([]string, error) {
+	unlock, err := p.lock()
+	if err != nil {
+		PrintVerboseErr("PackageManager.compactRemovals", 0, err)
+		return nil, err
+	}
+	defer unlock()
+
+	pkgsRemove, err := p.GetRemovePackages()
+	if err != nil {
+		PrintVerboseErr("PackageManager.compactRemovals", 1, err)
+		return nil, err
+	}
+
+	kept := []string{}
+	compacted := []string{}
+	for _, pkg := range pkgsRemove {
+		if pkg == "" {
+			continue
+		}
+
+		compact, err := compactable(pkg)
+		if err != nil {
+			PrintVerboseErr("PackageManager.compactRemovals", 2, err)
+			return nil, err
+		}
+
+		if compact {
+			compacted = append(compacted, pkg)
+		} else {
+			kept = append(kept, pkg)
+		}
+	}
+
+	if len(compacted) == 0 {
+		PrintVerboseInfo("PackageManager.compactRemovals", "no removals to compact")
+		return compacted, nil
+	}
+
+	PrintVerboseInfo("PackageManager.compactRemovals", "writing packages.remove")
+	err = p.writeRemovePackages(kept)
+	if err != nil {
+		PrintVerboseErr("PackageManager.compactRemovals", 3, err)
+		return nil, err
+	}
+
+	return compacted, nil
+}
+
+// DefaultPackageSource is the source of the packages which are not installed
+// from a specific release
+const DefaultPackageSource = "default"
+
+// GetAddPackagesBySource returns the packages in the packages.add file grouped
+// by the release they are installed from, as set by the -t/--target-release
+// install options. Packages without a target release are listed under
+// DefaultPackageSource
+func (p *PackageManager) GetAddPackagesBySource() (map[string][]string, error) {
+	PrintVerboseInfo("PackageManager.GetAddPackagesBySource", "running...")
+
+	pkgs, err := p.GetAddPackages()
+	if err != nil {
+		PrintVerboseErr("PackageManager.GetAddPackagesBySource", 0, err)
+		return nil, err
+	}
+
+	sources := map[string][]string{}
+	for _, pkg := range pkgs {
+		names, options := splitPackageOptions(pkg)
+		source := packageSource(options)
+		for _, name := range strings.Fields(names) {
+			sources[source] = append(sources[source], name)
+		}
+	}
+
+	return sources, nil
+}
+
+// packageSource returns the target release set in the given install options,
+// or DefaultPackageSource if there is none
+func packageSource(options string) string {
+	fields := strings.Fields(options)
+	for i, field := range fields {
+		switch {
+		case field == "-t" || field == "--target-release":
+			if i+1 < len(fields) {
+				return fields[i+1]
+			}
+		case strings.HasPrefix(field, "-t="):
+			return strings.TrimPrefix(field, "-t=")
+		case strings.HasPrefix(field, "--target-release="):
+			return strings.TrimPrefix(field, "--target-release=")
+		}
+	}
+
+	return DefaultPackageSource
+}
+
+// GetDefaultRemoves returns the packages in the packages.removedefaults file,
+// which are the removals shipped with the image. This file is read-only and
+// only used to seed packages.remove when it is missing or has no entries
+func (p *PackageManager) GetDefaultRemoves() ([]string, error) {
+	PrintVerboseInfo("PackageManager.GetDefaultRemoves", "running...")
+
+	_, err := os.Stat(filepath.Join(p.baseDir, PackagesRemoveDefaultsFile))
+	if err != nil {
+		PrintVerboseInfo("PackageManager.GetDefaultRemoves", "no default removals shipped")
+		return []string{}, nil
+	}
+
+	pkgs, err := p.getPackages(PackagesRemoveDefaultsFile)
+	if err != nil {
+		PrintVerboseErr("PackageManager.GetDefaultRemoves", 0, err)
+		return nil, err
+	}
+
+	defaults := []string{}
+	for _, pkg := range pkgs {
+		if pkg != "" {
+			defaults = append(defaults, pkg)
+		}
+	}
+
+	return defaults, nil
+}
+
+// PackageDisposition returns the state of a package across all the package
+// manager files: whether it is added, removed, held, excluded from upgrades
+// or has an unstaged change pending
+func (p *PackageManager) PackageDisposition(pkg string) (Disposition, error) {
+	PrintVerboseInfo("PackageManager.PackageDisposition", "running...")
+
+	disposition := Disposition{}
+	files := []struct {
+		file  string
+		field *bool
+	}{
+		{PackagesAddFile, &disposition.Added},
+		{PackagesRemoveFile, &disposition.Removed},
+		{PackagesHoldFile, &disposition.Held},
+		{PackagesExcludeFile, &disposition.Excluded},
+	}
+
+	for _, f := range files {
+		pkgs, err := p.getPackagesIfExists(f.file)
+		if err != nil {
+			PrintVerboseErr("PackageManager.PackageDisposition", 0, err)
+			return Disposition{}, err
+		}
+		*f.field = containsPackage(pkgs, pkg)
+	}
+
+	upkgs, err := p.GetUnstagedPackages()
+	if err != nil {
+		PrintVerboseErr("PackageManager.PackageDisposition", 1, err)
+		return Disposition{}, err
+	}
+	for _, upkg := range upkgs {
+		if containsPackage([]string{upkg.Name}, pkg) {
+			disposition.Pending = true
+			break
+		}
+	}
+
+	return disposition, nil
+}
+
+// GetPackageState returns whether a package is staged for addition (ADD) or
+// removal (REMOVE), or an empty string if it is neither. A pending unstaged
+// change takes precedence over packages.add and packages.remove, since it
+// is what the next apply does
+func (p *PackageManager) GetPackageState(pkg string) (string, error) {
+	PrintVerboseInfo("PackageManager.GetPackageState", "running...")
+
+	upkgs, err := p.GetUnstagedPackages()
+	if err != nil {
+		PrintVerboseErr("PackageManager.GetPackageState", 0, err)
+		return "", err
+	}
+	for _, upkg := range upkgs {
+		if containsPackage([]string{upkg.Name}, pkg) {
+			return upkg.Status, nil
+		}
+	}
+
+	pkgsAdd, err := p.GetAddPackages()
+	if err != nil {
+		PrintVerboseErr("PackageManager.GetPackageState", 1, err)
+		return "", err
+	}
+	if containsPackage(pkgsAdd, pkg) {
+		return ADD, nil
+	}
+
+	pkgsRemove, err := p.GetRemovePackages()
+	if err != nil {
+		PrintVerboseErr("PackageManager.GetPackageState", 2, err)
+		return "", err
+	}
+	if containsPackage(pkgsRemove, pkg) {
+		return REMOVE, nil
+	}
+
+	return "", nil
+}
+
+// IsStaged checks if a package is staged for addition or removal, see
+// GetPackageState
+func (p *PackageManager) IsStaged(pkg string) (bool, error) {
+	PrintVerboseInfo("PackageManager.IsStaged", "running...")
+
+	state, err := p.GetPackageState(pkg)
+	if err != nil {
+		PrintVerboseErr("PackageManager.IsStaged", 0, err)
+		return false, err
+	}
+
+	return state != "", nil
+}
+
+// containsPackage checks if pkg is one of the given entries, entries listing
+// multiple space-separated packages are taken into account
+func containsPackage(entries []string, pkg string) bool {
+	for _, entry := range entries {
+		entry, _ = splitPackageOptions(entry)
+		for _, name := range strings.Fields(entry) {
+			if name == pkg {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// GetUnstagedPackages returns the package changes that are yet to be applied
+func (p *PackageManager) GetUnstagedPackages() ([]UnstagedPackage, error) {
+	PrintVerboseInfo("PackageManager.GetUnstagedPackages", "running...")
+	return p.getUnstagedPackages(PackagesUnstagedFile)
+}
+
+func (p *PackageManager) getUnstagedPackages(file string) ([]UnstagedPackage, error) {
+	PrintVerboseInfo("PackageManager.getUnstagedPackages", "running...")
+	pkgs, err := p.getPackages(file)
+	if err != nil {
+		PrintVerboseErr("PackageManager.getUnstagedPackages", 0, err)
+		return nil, err
+	}
+
+	// malformed lines, which can come from manual edits or a corrupted
+	// file, are skipped so that the valid ones are still usable, they are
+	// reported by InspectUnstaged
+	unstagedList := []UnstagedPackage{}
+	for _, line := range pkgs {
+		if line == "" {
+			continue
+		}
+
+		status, name, found := strings.Cut(line, " ")
+		name = strings.TrimSpace(name)
+		if !found || name == "" || (status != ADD && status != REMOVE) {
+			PrintVerboseWarn("PackageManager.getUnstagedPackages", 1, "skipping malformed line in", file+":", line)
+			continue
+		}
+		unstagedList = append(unstagedList, UnstagedPackage{name, status})
+	}
+
+	return unstagedList, nil
+}
+
+// GetUnstagedPackagesPlain returns the package changes that are yet to be applied
+// as strings
+func (p *PackageManager) GetUnstagedPackagesPlain() ([]string, error) {
+	PrintVerboseInfo("PackageManager.GetUnstagedPackagesPlain", "running...")
+	pkgs, err := p.GetUnstagedPackages()
+	if err != nil {
+		PrintVerboseErr("PackageManager.GetUnstagedPackagesPlain", 0, err)
+		return nil, err
+	}
+
+	unstagedList := []string{}
+	for _, pkg := range pkgs {
+		unstagedList = append(unstagedList, pkg.Name)
+	}
+
+	return unstagedList, nil
+}
+
+// GetUnstagedByStatus returns the package changes that are yet to be applied
+// with the given status, ADD or REMOVE, once the changes cancelling each
+// other are dropped
+func (p *PackageManager) GetUnstagedByStatus(status string) ([]UnstagedPackage, error) {
+	PrintVerboseInfo("PackageManager.GetUnstagedByStatus", "running...")
+
+	if status != ADD && status != REMOVE {
+		err := fmt.Errorf("unknown package status %q, expected %s or %s", status, ADD, REMOVE)
+		PrintVerboseErr("PackageManager.GetUnstagedByStatus", 0, err)
+		return nil, err
+	}
+
+	upkgs, err := p.GetUnstagedPackages()
+	if err != nil {
+		PrintVerboseErr("PackageManager.GetUnstagedByStatus", 1, err)
+		return nil, err
+	}
+
+	// complementary operations cancel each other, as in UnstagedCounts
+	filtered := []UnstagedPackage{}
+	for _, upkg := range resolveUnstagedPackages(upkgs) {
+		if upkg.Status == status {
+			filtered = append(filtered, upkg)
+		}
+	}
+
+	return filtered, nil
+}
+
+// UnstagedCounts returns how many packages the next apply will actually
+// install and remove. Unlike the raw unstaged list, duplicates and
+// complementary operations are resolved first, the file is not rewritten
+func (p *PackageManager) UnstagedCounts() (adds int, removes int, err error) {
+	PrintVerboseInfo("PackageManager.UnstagedCounts", "running...")
+
+	upkgs, err := p.GetUnstagedPackages()
+	if err != nil {
+		PrintVerboseErr("PackageManager.UnstagedCounts", 0, err)
+		return 0, 0, err
+	}
+
+	for _, pkg := range resolveUnstagedPackages(upkgs) {
+		switch pkg.Status {
+		case ADD:
+			adds++
+		case REMOVE:
+			removes++
+		}
+	}
+
+	return adds, removes, nil
+}
+
+// GetUnstagedCount returns how many package changes the next apply will
+// perform, blank lines of the unstaged list are ignored and duplicates are
+// resolved as in UnstagedCounts
+func (p *PackageManager) GetUnstagedCount() (int, error) {
+	PrintVerboseInfo("PackageManager.GetUnstagedCount", "running...")
+
+	adds, removes, err := p.UnstagedCounts()
+	if err != nil {
+		PrintVerboseErr("PackageManager.GetUnstagedCount", 0, err)
+		return 0, err
+	}
+
+	return adds + removes, nil
+}
+
+// HasUnstagedChanges checks if there are package changes yet to be applied,
+// e.g. to warn the user before a reboot
+func (p *PackageManager) HasUnstagedChanges() (bool, error) {
+	PrintVerboseInfo("PackageManager.HasUnstagedChanges", "running...")
+
+	count, err := p.GetUnstagedCount()
+	if err != nil {
+		PrintVerboseErr("PackageManager.HasUnstagedChanges", 0, err)
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+// InspectUnstaged parses the packages.unstaged file, reporting malformed,
+// duplicate and contradictory lines, which can be introduced by manual edits.
+// The resolution of the valid lines is returned, the file is not rewritten
+func (p *PackageManager) InspectUnstaged() (clean []UnstagedPackage, problems []string, err error) {
+	PrintVerboseInfo("PackageManager.InspectUnstaged", "running...")
+
+	b, err := os.ReadFile(filepath.Join(p.baseDir, PackagesUnstagedFile))
+	if err != nil {
+		PrintVerboseErr("PackageManager.InspectUnstaged", 0, err)
+		return nil, nil, err
+	}
+	content := normalizePackageFile(b)
+
+	_, body, err := parseFormatHeader(content)
+	if err != nil {
+		PrintVerboseErr("PackageManager.InspectUnstaged", 1, err)
+		return nil, nil, err
+	}
+
+	// line numbers refer to the file, header included
+	offset := 1 + strings.Count(content[:len(content)-len(body)], "\n")
+
+	valid := []UnstagedPackage{}
+	seen := map[string]UnstagedPackage{}
+	for i, line := range strings.Split(body, "\n") {
+		line, _ = stripPackageComment(line)
+		if line == "" {
+			continue
+		}
+
+		splits := strings.SplitN(line, " ", 2)
+		if len(splits) != 2 || strings.TrimSpace(splits[1]) == "" {
+			problems = append(problems, fmt.Sprintf("line %d: malformed entry %q", i+offset, line))
+			continue
+		}
+
+		pkg := UnstagedPackage{strings.TrimSpace(splits[1]), splits[0]}
+		if pkg.Status != ADD && pkg.Status != REMOVE {
+			problems = append(problems, fmt.Sprintf("line %d: unknown operation %q for %s", i+offset, pkg.Status, pkg.Name))
+			continue
+		}
+
+		if previous, ok := seen[pkg.Name]; ok {
+			if previous.Status == pkg.Status {
+				problems = append(problems, fmt.Sprintf("line %d: duplicate operation %s for %s", i+offset, pkg.Status, pkg.Name))
+			} else {
+				problems = append(problems, fmt.Sprintf("line %d: operation %s contradicts %s for %s", i+offset, pkg.Status, previous.Status, pkg.Name))
+			}
+		}
+		seen[pkg.Name] = pkg
+		valid = append(valid, pkg)
+	}
+
+	return resolveUnstagedPackages(valid), problems, nil
+}
+
+// ClearUnstagedPackages removes all packages from the unstaged list
+func (p *PackageManager) ClearUnstagedPackages() error {
+	PrintVerboseInfo("PackageManager.ClearUnstagedPackages", "running...")
+
+	unlock, err := p.lock()
+	if err != nil {
+		PrintVerboseErr("PackageManager.ClearUnstagedPackages", 0, err)
+		return err
+	}
+	defer unlock()
+
+	upkgs, err := p.GetUnstagedPackages()
+	if err != nil {
+		PrintVerboseErr("PackageManager.ClearUnstagedPackages", 0, err)
+		return err
+	}
+	if len(upkgs) == 0 {
+		PrintVerboseInfo("PackageManager.ClearUnstagedPackages", "no unstaged packages, nothing to clear")
+		// a chunked apply interrupted after its last chunk left nothing to
+		// clear but its resume marker
+		return p.removeResumeMarker()
+	}
+
+	err = p.writeUnstagedPackages([]UnstagedPackage{})
+	if err != nil {
+		PrintVerboseErr("PackageManager.ClearUnstagedPackages", 1, err)
+		return err
+	}
+
+	err = p.recordChange(CLEAR, "")
+	if err != nil {
+		PrintVerboseErr("PackageManager.ClearUnstagedPackages", 1.1, err)
+		return err
+	}
+
+	// every change is applied, an interrupted chunked apply is superseded
+	return p.removeResumeMarker()
+}
+
+// RecordLastApply stores the unstaged packages in the packages.lastapply file,
+// so that the change set can be restaged later. This should be called right
+// before the unstaged packages are consumed by an apply operation
+func (p *PackageManager) RecordLastApply() error {
+	PrintVerboseInfo("PackageManager.RecordLastApply", "running...")
+
+	unlock, err := p.lock()
+	if err != nil {
+		PrintVerboseErr("PackageManager.RecordLastApply", 0, err)
+		return err
+	}
+	defer unlock()
+
+	upkgs, err := p.GetUnstagedPackages()
+	if err != nil {
+		PrintVerboseErr("PackageManager.RecordLastApply", 1, err)
+		return err
+	}
+
+	if len(upkgs) == 0 {
+		PrintVerboseInfo("PackageManager.RecordLastApply", "no unstaged packages, keeping the previous record")
+		return nil
+	}
+
+	pkgFmt := []string{}
+	for _, pkg := range upkgs {
+		pkgFmt = append(pkgFmt, fmt.Sprintf("%s %s", pkg.Status, pkg.Name))
+	}
+
+	return p.writePackages(PackagesLastApplyFile, pkgFmt)
+}
+
+// GetLastApply returns the package changes recorded during the last apply
+// operation, it fails if no apply was recorded yet
+func (p *PackageManager) GetLastApply() ([]UnstagedPackage, error) {
+	PrintVerboseInfo("PackageManager.GetLastApply", "running...")
+
+	_, err := os.Stat(filepath.Join(p.baseDir, PackagesLastApplyFile))
+	if err != nil {
+		PrintVerboseErr("PackageManager.GetLastApply", 0, err)
+		return nil, errors.New("no previous apply was recorded")
+	}
+
+	upkgs, err := p.getUnstagedPackages(PackagesLastApplyFile)
+	if err != nil {
+		PrintVerboseErr("PackageManager.GetLastApply", 1, err)
+		return nil, err
+	}
+
+	if len(upkgs) == 0 {
+		return nil, errors.New("no previous apply was recorded")
+	}
+
+	return upkgs, nil
+}
+
+// RestageLastApply stages again the package changes recorded during the last
+// apply operation, so that they are applied to the next root
+func (p *PackageManager) RestageLastApply() error {
+	PrintVerboseInfo("PackageManager.RestageLastApply", "running...")
+
+	err := p.CheckStatus()
+	if err != nil {
+		PrintVerboseErr("PackageManager.RestageLastApply", 0, err)
+		return err
+	}
+
+	unlock, err := p.lock()
+	if err != nil {
+		PrintVerboseErr("PackageManager.RestageLastApply", 0.5, err)
+		return err
+	}
+	defer unlock()
+
+	lastApply, err := p.GetLastApply()
+	if err != nil {
+		PrintVerboseErr("PackageManager.RestageLastApply", 1, err)
+		return err
+	}
+
+	upkgs, err := p.GetUnstagedPackages()
+	if err != nil {
+		PrintVerboseErr("PackageManager.RestageLastApply", 2, err)
+		return err
+	}
+
+	upkgs = append(upkgs, lastApply...)
+
+	PrintVerboseInfo("PackageManager.RestageLastApply", "writing packages.unstaged")
+	return p.writeUnstagedPackages(upkgs)
+}
+
+// GetAddPackagesString returns the packages in the packages.add file as a string
+func (p *PackageManager) GetAddPackagesString(sep string) (string, error) {
+	PrintVerboseInfo("PackageManager.GetAddPackagesString", "running...")
+	pkgs, err := p.GetAddPackages()
+	if err != nil {
+		PrintVerboseErr("PackageManager.GetAddPackagesString", 0, err)
+		return "", err
+	}
+
+	PrintVerboseInfo("PackageManager.GetAddPackagesString", "done")
+	return strings.Join(pkgs, sep), nil
+}
+
+// GetAddPackagesStringSafe works like GetAddPackagesString but fails if any
+// package contains the separator, so that the resulting string can be split
+// back into the original packages without ambiguity
+func (p *PackageManager) GetAddPackagesStringSafe(sep string) (string, error) {
+	PrintVerboseInfo("PackageManager.GetAddPackagesStringSafe", "running...")
+
+	if sep == "" {
+		err := errors.New("the separator cannot be empty")
+		PrintVerboseErr("PackageManager.GetAddPackagesStringSafe", 0, err)
+		return "", err
+	}
+
+	pkgs, err := p.GetAddPackages()
+	if err != nil {
+		PrintVerboseErr("PackageManager.GetAddPackagesStringSafe", 1, err)
+		return "", err
+	}
+
+	for _, pkg := range pkgs {
+		if strings.Contains(pkg, sep) {
+			err := fmt.Errorf("package %s contains the separator %q", pkg, sep)
+			PrintVerboseErr("PackageManager.GetAddPackagesStringSafe", 2, err)
+			return "", err
+		}
+	}
+
+	PrintVerboseInfo("PackageManager.GetAddPackagesStringSafe", "done")
+	return strings.Join(pkgs, sep), nil
+}
+
+// GetRemovePackagesString returns the packages in the packages.remove file as a string
+func (p *PackageManager) GetRemovePackagesString(sep string) (string, error) {
+	PrintVerboseInfo("PackageManager.GetRemovePackagesString", "running...")
+	pkgs, err := p.GetRemovePackages()
+	if err != nil {
+		PrintVerboseErr("PackageManager.GetRemovePackagesString", 0, err)
+		return "", err
+	}
+
+	PrintVerboseInfo("PackageManager.GetRemovePackagesString", "done")
+	return strings.Join(pkgs, sep), nil
+}
+
+func (p *PackageManager) getPackages(file string) ([]string, error) {
+	PrintVerboseInfo("PackageManager.getPackages", "running...")
+
+	pkgs := []string{}
+	f, err := os.Open(filepath.Join(p.baseDir, file))
+	if err != nil {
+		PrintVerboseErr("PackageManager.getPackages", 0, err)
+		return pkgs, err
+	}
+	defer f.Close()
+
+	b, err := io.ReadAll(f)
+	if err != nil {
+		PrintVerboseErr("PackageManager.getPackages", 1, err)
+		return pkgs, err
+	}
+
+	pkgs, err = parsePackageEntries(b)
+	if err != nil {
+		PrintVerboseErr("PackageManager.getPackages", 2, err)
+		return []string{}, fmt.Errorf("%s: %w", file, err)
+	}
+
+	PrintVerboseInfo("PackageManager.getPackages", "returning packages")
+	return pkgs, nil
+}
+
+// parsePackageEntries returns the entries of the content of a package file,
+// without its format header, comments and blank lines
+func parsePackageEntries(content []byte) ([]string, error) {
+	_, body, err := parseFormatHeader(normalizePackageFile(content))
+	if err != nil {
+		return nil, err
+	}
+
+	// comments are skipped whatever the format version, since '#' can't
+	// be part of a package name
+	pkgs := []string{}
+	for _, line := range strings.Split(body, "\n") {
+		entry, _ := stripPackageComment(line)
+		if entry == "" {
+			continue
+		}
+		pkgs = append(pkgs, entry)
+	}
+
+	return pkgs, nil
+}
+
+// normalizePackageFile returns the content of a package file without a
+// leading UTF-8 BOM and with Unix line endings, as files edited on Windows
+// or by some editors would otherwise yield entries with stray characters
+func normalizePackageFile(content []byte) string {
+	normalized := strings.TrimPrefix(string(content), "\ufeff")
+	normalized = strings.ReplaceAll(normalized, "\r\n", "\n")
+	return strings.ReplaceAll(normalized, "\r", "\n")
+}
+
+// parseFormatHeader returns the format version of a package file and its
+// content without the header. Files without a header are version 1, files
+// written by a newer version of ABRoot are rejected
+func parseFormatHeader(content string) (version int, body string, err error) {
+	firstLine, rest, _ := strings.Cut(content, "\n")
+	if !strings.HasPrefix(firstLine, PackageFileFormatHeader) {
+		return 1, content, nil
+	}
+
+	versionStr := strings.TrimSpace(strings.TrimPrefix(firstLine, PackageFileFormatHeader))
+	version, err = strconv.Atoi(versionStr)
+	if err != nil || version < 1 {
+		return 0, "", fmt.Errorf("invalid format version %q", versionStr)
+	}
+	if version > PackageFileFormatVersion {
+		return 0, "", fmt.Errorf("unsupported format version %d, the newest supported one is %d", version, PackageFileFormatVersion)
+	}
+
+	return version, rest, nil
+}
+
+// getPackagesIfExists works like getPackages but returns no packages if the
+// file does not exist, this is meant for optional files
+func (p *PackageManager) getPackagesIfExists(file string) ([]string, error) {
+	_, err := os.Stat(filepath.Join(p.baseDir, file))
+	if errors.Is(err, os.ErrNotExist) {
+		return []string{}, nil
+	}
+
+	return p.getPackages(file)
+}
+
+func (p *PackageManager) writeAddPackages(pkgs []string) error {
+	PrintVerboseInfo("PackageManager.writeAddPackages", "running...")
+	return p.writePackages(PackagesAddFile, dedupPackages(pkgs))
+}
+
+func (p *PackageManager) writeRemovePackages(pkgs []string) error {
+	PrintVerboseInfo("PackageManager.writeRemovePackages", "running...")
+	return p.writePackages(PackagesRemoveFile, dedupPackages(pkgs))
+}
+
+// dedupPackages returns the given package entries without the ones whose
+// package is already listed, in first-seen order, so that duplicates coming
+// from external edits of the package files are not written back. Entries of
+// the same package with different install options or versions are
+// duplicates too
+func dedupPackages(pkgs []string) []string {
+	seen := map[string]bool{}
+	deduped := []string{}
+	for _, pkg := range pkgs {
+		name := packageKey(pkg)
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		deduped = append(deduped, pkg)
+	}
+
+	return deduped
+}
+
+func (p *PackageManager) writeUnstagedPackages(pkgs []UnstagedPackage) error {
+	PrintVerboseInfo("PackageManager.writeUnstagedPackages", "running...")
+
+	pkgsCleaned := resolveUnstagedPackages(pkgs)
+
+	pkgFmt := []string{}
+	for _, pkg := range pkgsCleaned {
+		pkgFmt = append(pkgFmt, fmt.Sprintf("%s %s", pkg.Status, pkg.Name))
+	}
+
+	return p.writePackages(PackagesUnstagedFile, pkgFmt)
+}
+
+// resolveUnstagedPackages returns the given unstaged packages without
+// redundant entries, duplicates are dropped while complementary operations
+// (+ then - or - then +) cancel each other
+func resolveUnstagedPackages(pkgs []UnstagedPackage) []UnstagedPackage {
+	pkgsCleaned := []UnstagedPackage{}
+	for _, pkg := range pkgs {
+		isDuplicate := false
+		for iCmp, pkgCmp := range pkgsCleaned {
+			if packageKey(pkg.Name) == packageKey(pkgCmp.Name) {
+				isDuplicate = true
+
+				// remove complement (+ then - or - then +), while a repeated
+				// operation keeps the latest entry, which may pin another
+				// version or use other options
+				if pkg.Status != pkgCmp.Status {
+					pkgsCleaned = append(pkgsCleaned[:iCmp], pkgsCleaned[iCmp+1:]...)
+				} else {
+					pkgsCleaned[iCmp] = pkg
+				}
+
+				break
+			}
+		}
+
+		// don't add duplicate
+		if !isDuplicate {
+			pkgsCleaned = append(pkgsCleaned, pkg)
+		}
+	}
+
+	return pkgsCleaned
+}
+
+// writePackages writes the given packages to a package file, keeping the
+// comments of the packages still listed
+func (p *PackageManager) writePackages(file string, pkgs []string) error {
+	PrintVerboseInfo("PackageManager.writePackages", "running...")
+	return p.writePackagesCommented(file, pkgs, p.readPackageComments(file))
+}
+
+// writePackagesCommented writes the given packages to a package file along
+// with the given comments
+func (p *PackageManager) writePackagesCommented(file string, pkgs []string, comments packageComments) error {
+	PrintVerboseInfo("PackageManager.writePackagesCommented", "running...")
+
+	// the packages are written to a temporary file which then replaces
+	// the target, so that a failed write never leaves it truncated
+	path := filepath.Join(p.baseDir, file)
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, packagesFileMode)
+	if err != nil {
+		PrintVerboseErr("PackageManager.writePackagesCommented", 0, err)
+		return err
+	}
+
+	err = writePackagesTo(f, pkgs, comments)
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		PrintVerboseErr("PackageManager.writePackagesCommented", 1, err)
+		return err
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		os.Remove(tmpPath)
+		PrintVerboseErr("PackageManager.writePackagesCommented", 2, err)
+		return err
+	}
+
+	p.trace("write", file)
+	PrintVerboseInfo("PackageManager.writePackagesCommented", "packages written")
+	return nil
+}
+
+// writePackagesTo writes the format header and the given packages to the
+// writer, skipping empty entries. The comments of the entries still listed
+// are written along with them, see packageComments
+func writePackagesTo(w io.Writer, pkgs []string, comments packageComments) error {
+	_, err := fmt.Fprintf(w, "%s %d\n", PackageFileFormatHeader, PackageFileFormatVersion)
+	if err != nil {
+		return err
+	}
+
+	for _, pkg := range pkgs {
+		if pkg == "" {
+			continue
+		}
+
+		key := packageKey(pkg)
+		for _, comment := range comments.leading[key] {
+			_, err = fmt.Fprintf(w, "%s\n", comment)
+			if err != nil {
+				return err
+			}
+		}
+
+		line := pkg
+		if inline, ok := comments.inline[key]; ok {
+			line = fmt.Sprintf("%s %s", pkg, inline)
+		}
+		_, err = fmt.Fprintf(w, "%s\n", line)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, comment := range comments.trailing {
+		_, err = fmt.Fprintf(w, "%s\n", comment)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// stripPackageComment splits a package file line into its entry and its
+// comment, which starts at the first '#' and may follow the entry or take
+// the whole line. Both are trimmed
+func stripPackageComment(line string) (entry string, comment string) {
+	entry, comment, found := strings.Cut(line, "#")
+	if !found {
+		return strings.TrimSpace(line), ""
+	}
+
+	return strings.TrimSpace(entry), "#" + strings.TrimRightFunc(comment, unicode.IsSpace)
+}
+
+// packageComments are the comments of a package file, kept so that rewriting
+// the file preserves them. Comment lines are attached to the entry following
+// them and are dropped along with it, while the ones after the last entry
+// are kept at the end of the file. Comments are attached to the packages of
+// the entries, see packageKey, so that they survive an update of their
+// version pins or install options
+type packageComments struct {
+	leading  map[string][]string
+	inline   map[string]string
+	trailing []string
+}
+
+// readPackageComments returns the comments of a package file, none if the
+// file can't be read
+func (p *PackageManager) readPackageComments(file string) packageComments {
+	comments := packageComments{leading: map[string][]string{}, inline: map[string]string{}}
+
+	content, err := os.ReadFile(filepath.Join(p.baseDir, file))
+	if err != nil {
+		return comments
+	}
+	_, body, err := parseFormatHeader(normalizePackageFile(content))
+	if err != nil {
+		return comments
+	}
+
+	pending := []string{}
+	for _, line := range strings.Split(body, "\n") {
+		entry, comment := stripPackageComment(line)
+		if entry == "" {
+			if comment != "" {
+				pending = append(pending, comment)
+			}
+			continue
+		}
+
+		key := packageKey(entry)
+		if len(pending) > 0 {
+			comments.leading[key] = pending
+			pending = []string{}
+		}
+		if comment != "" {
+			comments.inline[key] = comment
+		}
+	}
+	comments.trailing = pending
+
+	return comments
+}
+
+func (p *PackageManager) processApplyPackages() ([]string, []string, error) {
+	PrintVerboseInfo("PackageManager.processApplyPackages", "running...")
+
+	unstaged, err := p.GetUnstagedPackages()
+	if err != nil {
+		PrintVerboseErr("PackageManager.processApplyPackages", 0, err)
+		return nil, nil, err
+	}
+
+	var addPkgs, removePkgs []string
+	for _, pkg := range unstaged {
+		switch pkg.Status {
+		case ADD:
+			addPkgs = append(addPkgs, pkg.Name)
+		case REMOVE:
+			removePkgs = append(removePkgs, pkg.Name)
+		}
+	}
+
+	if settings.Cnf.IPkgMngOrderByDeps {
+		addPkgs = p.orderByDeps(addPkgs)
+	}
+
+	return addPkgs, removePkgs, nil
+}
+
+// pkgCmdMaxBytes is the size limit of a single package command, well below
+// the argument limit of the common systems
+const pkgCmdMaxBytes = 32 * 1024
+
+// pkgCmd appends the given packages to a command template, each followed by
+// its install options if any. It returns an empty string if there are no
+// packages. Names and option words are shell-quoted when needed so that they
+// are always passed as arguments, names starting with a dash are rejected
+// since the package manager would read them as flags. Large package sets
+// are split into several invocations of the template chained with &&, see
+// chunkPkgArgs
+func pkgCmd(template string, pkgs []string) (string, error) {
+	entries := [][]string{}
+	for _, pkg := range pkgs {
+		entry, options := splitPackageOptions(pkg)
+		if entry == "" {
+			continue
+		}
+
+		args := []string{}
+		for _, name := range strings.Fields(entry) {
+			if strings.HasPrefix(name, "-") {
+				return "", fmt.Errorf("package name %s would be read as a flag by the package manager", name)
+			}
+			args = append(args, shellQuote(formatPackageVersion(name)))
+		}
+		words, err := packageOptionWords(options)
+		if err != nil {
+			return "", err
+		}
+		for _, word := range words {
+			args = append(args, shellQuote(word))
+		}
+		entries = append(entries, args)
+	}
+
+	cmds := []string{}
+	for _, chunk := range chunkPkgArgs(template, entries) {
+		cmds = append(cmds, fmt.Sprintf("%s %s", template, strings.Join(chunk, " ")))
+	}
+
+	return strings.Join(cmds, " && "), nil
+}
+
+// chunkPkgArgs groups the arguments of the given package entries into the
+// invocations of a command template. An invocation holds at most
+// settings.Cnf.IPkgMngMaxPkgsPerCmd entries, if set, and is kept within
+// pkgCmdMaxBytes. Entries are never split, so an entry larger than the limit
+// gets an invocation of its own
+func chunkPkgArgs(template string, entries [][]string) [][]string {
+	chunks := [][]string{}
+	chunk := []string{}
+	chunkEntries := 0
+	size := len(template)
+	for _, entry := range entries {
+		entrySize := 0
+		for _, arg := range entry {
+			entrySize += len(arg) + 1
+		}
+
+		full := settings.Cnf.IPkgMngMaxPkgsPerCmd > 0 && chunkEntries >= settings.Cnf.IPkgMngMaxPkgsPerCmd
+		if chunkEntries > 0 && (full || size+entrySize > pkgCmdMaxBytes) {
+			chunks = append(chunks, chunk)
+			chunk = []string{}
+			chunkEntries = 0
+			size = len(template)
+		}
+
+		chunk = append(chunk, entry...)
+		chunkEntries++
+		size += entrySize
+	}
+	if chunkEntries > 0 {
+		chunks = append(chunks, chunk)
+	}
+
+	return chunks
+}
+
+// packageOptionWords splits the install options of a package entry into
+// words, see shellWords. Options chaining another command or holding control
+// characters are rejected, so that they can only ever be arguments of the
+// package manager
+func packageOptionWords(options string) ([]string, error) {
+	if options == "" {
+		return nil, nil
+	}
+
+	for _, c := range options {
+		if unicode.IsControl(c) && c != '\t' {
+			return nil, fmt.Errorf("the options %q contain the character %q", options, c)
+		}
+	}
+
+	words, err := shellWords(options)
+	if err != nil {
+		return nil, err
+	}
+	if slices.Contains(words, "&&") {
+		return nil, fmt.Errorf("the options %q chain another command", options)
+	}
+
+	return words, nil
+}
+
+// shellCommands splits a command chained with && into the argv slices of
+// its commands, see shellWords
+func shellCommands(cmd string) ([][]string, error) {
+	words, err := shellWords(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	cmds := [][]string{}
+	current := []string{}
+	for _, word := range words {
+		if word != "&&" {
+			current = append(current, word)
+			continue
+		}
+		if len(current) == 0 {
+			return nil, fmt.Errorf("empty command in %q", cmd)
+		}
+		cmds = append(cmds, current)
+		current = []string{}
+	}
+	if len(current) > 0 {
+		cmds = append(cmds, current)
+	} else if len(cmds) > 0 {
+		return nil, fmt.Errorf("empty command in %q", cmd)
+	}
+
+	return cmds, nil
+}
+
+// shellWords splits a command into words as the shell would, honouring
+// single quotes, double quotes and backslashes. An unquoted && is returned
+// as a word of its own, while the other shell operators and expansions are
+// rejected since they can't be reproduced without a shell
+func shellWords(cmd string) ([]string, error) {
+	words := []string{}
+	var word strings.Builder
+	inWord := false
+	var quote rune
+
+	runes := []rune(cmd)
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+		switch {
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(c)
+			}
+		case quote == '"':
+			switch {
+			case c == '"':
+				quote = 0
+			case c == '\\' && i+1 < len(runes) && strings.ContainsRune("$`\"\\", runes[i+1]):
+				i++
+				word.WriteRune(runes[i])
+			case c == '$' || c == '`':
+				return nil, fmt.Errorf("%q uses shell expansions, which can't be run without a shell", cmd)
+			default:
+				word.WriteRune(c)
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			inWord = true
+		case c == '\\':
+			if i+1 < len(runes) {
+				i++
+				word.WriteRune(runes[i])
+			}
+			inWord = true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case c == '&' && i+1 < len(runes) && runes[i+1] == '&':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+			i++
+			words = append(words, "&&")
+		case strings.ContainsRune("&|;<>()$`", c):
+			return nil, fmt.Errorf("%q uses the shell operator %q, which can't be run without a shell", cmd, c)
+		default:
+			word.WriteRune(c)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("%q has an unterminated quote", cmd)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+
+	return words, nil
+}
+
+// shellQuote quotes a word for the shell unless it only contains characters
+// which are never special to it
+func shellQuote(word string) string {
+	safe := true
+	for _, c := range word {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("@%+=:,./_-", c)) {
+			safe = false
+			break
+		}
+	}
+	if safe {
+		return word
+	}
+
+	return "'" + strings.ReplaceAll(word, "'", `'\''`) + "'"
+}
+
+// ErrInvalidPackageName is wrapped by the errors of the package names which
+// contain characters not allowed by validatePackageName
+var ErrInvalidPackageName = errors.New("invalid package name")
+
+// packageNameChars are the characters allowed in package names besides ASCII
+// letters and digits, which covers the names of the common package managers
+// along with version pins (e.g. "bash=5.2") and releases (e.g. "bash/sid")
+const packageNameChars = "+-.:_~=@/"
+
+// validatePackageName checks that a package entry only contains ASCII
+// letters, digits and packageNameChars, so that it can't alter the command
+// it is interpolated into. If multiple is true, the entry can hold several
+// names separated by spaces, as accepted by Add. Names can't start with a
+// dash since the package manager would read them as flags. The install
+// options of the entry, if any, must be parsable by packageOptionWords
+func validatePackageName(pkg string, multiple bool) error {
+	name, options := splitPackageOptions(pkg)
+	if name == "" {
+		return fmt.Errorf("%w: the package name is empty", ErrInvalidPackageName)
+	}
+	if _, err := packageOptionWords(options); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidPackageName, err)
+	}
+
+	names := []string{name}
+	if multiple {
+		names = strings.Split(name, " ")
+	}
+	for _, n := range names {
+		if n == "" {
+			return fmt.Errorf("%w: %q contains consecutive spaces", ErrInvalidPackageName, pkg)
+		}
+		if strings.HasPrefix(n, "-") {
+			return fmt.Errorf("%w: %q would be read as a flag by the package manager", ErrInvalidPackageName, n)
+		}
+		if name, version := splitPackageVersion(n); name == "" || (version == "" && name != n) {
+			return fmt.Errorf("%w: %q has an empty name or version", ErrInvalidPackageName, n)
+		}
+		for _, c := range n {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune(packageNameChars, c)) {
+				return fmt.Errorf("%w: %q contains the character %q", ErrInvalidPackageName, pkg, c)
+			}
+		}
+	}
+
+	return nil
+}
+
+// PackageVersionSeparators are the separators of a package name and the
+// version it is pinned to, e.g. "bash=5.2" or "bash@5.2". Pins are stored
+// with "=" and formatted for the package manager by iPkgMngVersionFormat
+const PackageVersionSeparators = "=@"
+
+// splitPackageVersion splits a package name into the package and the version
+// it is pinned to, if any
+func splitPackageVersion(name string) (pkg string, version string) {
+	i := strings.IndexAny(name, PackageVersionSeparators)
+	if i == -1 {
+		return name, ""
+	}
+
+	return name[:i], name[i+1:]
+}
+
+// pinPackageEntry returns a package entry with its version pins in the
+// stored form, "name=version"
+func pinPackageEntry(entry string) string {
+	names, options := splitPackageOptions(entry)
+
+	pinned := []string{}
+	for _, name := range strings.Fields(names) {
+		pkg, version := splitPackageVersion(name)
+		if version != "" {
+			name = pkg + "=" + version
+		}
+		pinned = append(pinned, name)
+	}
+
+	if options == "" {
+		return strings.Join(pinned, " ")
+	}
+	return strings.Join(pinned, " ") + PackageOptionsSeparator + options
+}
+
+// packageKey returns the packages of an entry without their version pins and
+// install options, which is how the entry is matched against the others
+func packageKey(entry string) string {
+	names, _ := splitPackageOptions(entry)
+
+	pkgs := []string{}
+	for _, name := range strings.Fields(names) {
+		pkg, _ := splitPackageVersion(name)
+		pkgs = append(pkgs, pkg)
+	}
+
+	return strings.Join(pkgs, " ")
+}
+
+// formatPackageVersion returns the argument installing a package name,
+// formatting its version pin, if any, with iPkgMngVersionFormat
+func formatPackageVersion(name string) string {
+	pkg, version := splitPackageVersion(name)
+	if version == "" || settings.Cnf.IPkgMngVersionFormat == "" {
+		return name
+	}
+
+	return strings.NewReplacer("{packageName}", pkg, "{version}", version).Replace(settings.Cnf.IPkgMngVersionFormat)
+}
+
+// splitPackageOptions splits a package entry into the package name and its
+// install options, options are empty for plain entries
+func splitPackageOptions(entry string) (name string, options string) {
+	name, options, _ = strings.Cut(entry, PackageOptionsSeparator)
+	return strings.TrimSpace(name), strings.TrimSpace(options)
+}
+
+func (p *PackageManager) processUpgradePackages() ([]string, []string, error) {
+	addPkgs, err := p.GetAddPackages()
+	if err != nil {
+		PrintVerboseErr("PackageManager.processUpgradePackages", 0, err)
+		return nil, nil, err
+	}
+
+	removePkgs, err := p.GetRemovePackages()
+	if err != nil {
+		PrintVerboseErr("PackageManager.processUpgradePackages", 1, err)
+		return nil, nil, err
+	}
+
+	return addPkgs, removePkgs, nil
+}
+
+// GetFinalCmd returns the command performing the package changes of the
+// given operation, or an empty string if there is nothing to do or the
+// command was vetoed by the CommandPolicy
+func (p *PackageManager) GetFinalCmd(operation ABSystemOperation) string {
+	PrintVerboseInfo("PackageManager.GetFinalCmd", "running...")
+
+	plan, err := p.BuildPlan(operation)
+	if err != nil {
+		PrintVerboseErr("PackageManager.GetFinalCmd", 0, err)
+		return ""
+	}
+
+	PrintVerboseInfo("PackageManager.GetFinalCmd", "returning cmd: "+plan.Cmd)
+	return plan.Cmd
+}
+
+// BuildPlan returns a preview of the given operation: the packages it
+// installs and removes, the hooks run around them and the resolved command.
+// Nothing is changed on disk, so it can be used for dry-run previews. The
+// CommandPolicy is honoured as in BuildCommandPlan
+func (p *PackageManager) BuildPlan(operation ABSystemOperation) (*ApplyPlan, error) {
+	PrintVerboseInfo("PackageManager.BuildPlan", "running...")
+
+	cmdPlan, err := p.BuildCommandPlan(operation)
+	if err != nil {
+		PrintVerboseErr("PackageManager.BuildPlan", 0, err)
+		return nil, err
+	}
+
+	plan := &ApplyPlan{
+		Operation:      cmdPlan.Operation,
+		AddPackages:    cmdPlan.Add,
+		RemovePackages: cmdPlan.Remove,
+		Cmd:            cmdPlan.Cmd,
+	}
+	if plan.Cmd != "" {
+		plan.PreHook = joinHookCmds(settings.Cnf.IPkgMngPre, settings.Cnf.IPkgMngPreCmds)
+		plan.PostHook = joinHookCmds(settings.Cnf.IPkgMngPost, settings.Cnf.IPkgMngPostCmds)
+	}
+
+	return plan, nil
+}
+
+// BuildCommandPlan returns the packages the given operation installs and
+// removes, along with the command doing it. If a CommandPolicy is set, it is
+// given the plan and the error it returns, if any, aborts the operation
+func (p *PackageManager) BuildCommandPlan(operation ABSystemOperation) (CommandPlan, error) {
+	PrintVerboseInfo("PackageManager.BuildCommandPlan", "running...")
+
+	addPkgs, removePkgs, err := p.operationPackages(operation)
+	if err != nil {
+		PrintVerboseErr("PackageManager.BuildCommandPlan", 0, err)
+		return CommandPlan{}, err
+	}
+
+	cmd, err := p.builder().Build(operation, addPkgs, removePkgs)
+	if err != nil {
+		PrintVerboseErr("PackageManager.BuildCommandPlan", 0.1, err)
+		return CommandPlan{}, err
+	}
+
+	plan := CommandPlan{
+		Operation: operation,
+		Add:       packageNames(addPkgs),
+		Remove:    packageNames(removePkgs),
+		Cmd:       cmd,
+	}
+	if plan.Cmd == "" {
+		PrintVerboseInfo("PackageManager.BuildCommandPlan", "no packages to install or remove")
+	}
+
+	if p.CommandPolicy != nil {
+		err = p.CommandPolicy(plan)
+		if err != nil {
+			PrintVerboseErr("PackageManager.BuildCommandPlan", 1, err)
+			return CommandPlan{}, fmt.Errorf("command vetoed by policy: %w", err)
+		}
+	}
+
+	return plan, nil
+}
+
+// operationPackages returns the package entries the given operation
+// installs and removes. APPLY only installs the unstaged changes on top of
+// the present root, unless IPkgMngApplyUsesCommitted is set, in which case
+// the whole committed package set is processed, as during an upgrade
+func (p *PackageManager) operationPackages(operation ABSystemOperation) ([]string, []string, error) {
+	if operation == APPLY && !settings.Cnf.IPkgMngApplyUsesCommitted {
+		return p.processApplyPackages()
+	}
+
+	return p.processUpgradePackages()
+}
+
+// GetFinalCmdArgs works like GetFinalCmd but returns the commands as argv
+// slices, in the order GetFinalCmd chains them: the pre hooks, the add
+// commands, the remove commands and the post hooks. Each package name is a
+// separate element, so the commands can be executed without a shell. The
+// commands are split from the very command the CommandPolicy was given, so
+// they are built by the CommandBuilder or the Backend if set, and large
+// package sets are split into several commands as in GetFinalCmd. Commands
+// relying on shell features other than quoting and && chaining are rejected
+func (p *PackageManager) GetFinalCmdArgs(operation ABSystemOperation) ([][]string, error) {
+	PrintVerboseInfo("PackageManager.GetFinalCmdArgs", "running...")
+
+	plan, err := p.BuildCommandPlan(operation)
+	if err != nil {
+		PrintVerboseErr("PackageManager.GetFinalCmdArgs", 0, err)
+		return nil, err
+	}
+	if plan.Cmd == "" {
+		return [][]string{}, nil
+	}
+
+	cmds, err := shellCommands(plan.Cmd)
+	if err != nil {
+		PrintVerboseErr("PackageManager.GetFinalCmdArgs", 1, err)
+		return nil, err
+	}
+
+	return cmds, nil
+}
+
+// packageNames returns the package names listed in the given entries,
+// without their install options
+func packageNames(entries []string) []string {
+	names := []string{}
+	for _, entry := range entries {
+		entryNames, _ := splitPackageOptions(entry)
+		names = append(names, strings.Fields(entryNames)...)
+	}
+
+	return names
+}
+
+// InverseCommand returns the command which undoes the last recorded apply,
+// removing what was added and adding back what was removed. It fails if no
+// apply was recorded yet
+func (p *PackageManager) InverseCommand() (string, error) {
+	PrintVerboseInfo("PackageManager.InverseCommand", "running...")
+
+	lastApply, err := p.GetLastApply()
+	if err != nil {
+		PrintVerboseErr("PackageManager.InverseCommand", 0, err)
+		return "", err
+	}
+
+	var addPkgs, removePkgs []string
+	for _, pkg := range lastApply {
+		switch pkg.Status {
+		case ADD:
+			removePkgs = append(removePkgs, pkg.Name)
+		case REMOVE:
+			addPkgs = append(addPkgs, pkg.Name)
+		}
+	}
+
+	cmd, err := p.builder().Build(APPLY, addPkgs, removePkgs)
+	if err != nil {
+		PrintVerboseErr("PackageManager.InverseCommand", 1, err)
+		return "", err
+	}
+
+	PrintVerboseInfo("PackageManager.InverseCommand", "returning cmd: "+cmd)
+	return cmd, nil
+}
+
+// CommandBuilder builds the command installing and removing the given
+// packages for an operation. Package entries may carry install options, see
+// PackageOptionsSeparator
+type CommandBuilder interface {
+	Build(operation ABSystemOperation, add, remove []string) (string, error)
+}
+
+// TemplateCommandBuilder is the default CommandBuilder, it appends the
+// packages to the iPkgMngAdd and iPkgMngRm commands and wraps them with the
+// pre/post hooks
+type TemplateCommandBuilder struct{}
+
+// Build implements CommandBuilder
+func (TemplateCommandBuilder) Build(operation ABSystemOperation, add, remove []string) (string, error) {
+	addCmd, err := pkgCmd(settings.Cnf.IPkgMngAdd, add)
+	if err != nil {
+		return "", err
+	}
+	removeCmd, err := pkgCmd(settings.Cnf.IPkgMngRm, remove)
+	if err != nil {
+		return "", err
+	}
+
+	return composeCmd(addCmd, removeCmd), nil
+}
+
+// SetCommandBuilder sets the builder of the package manager commands, nil
+// restores the TemplateCommandBuilder
+func (p *PackageManager) SetCommandBuilder(builder CommandBuilder) {
+	p.commandBuilder = builder
+}
+
+// builder returns the command builder in use
+func (p *PackageManager) builder() CommandBuilder {
+	if p.commandBuilder != nil {
+		return p.commandBuilder
+	}
+	if p.backend != nil {
+		return backendCommandBuilder{p.backend}
+	}
+
+	return TemplateCommandBuilder{}
+}
+
+// composeCmd chains the add and remove commands and wraps them with the
+// pre/post hooks
+func composeCmd(finalAddPkgs, finalRemovePkgs string) string {
+	cmd := ""
+	if finalAddPkgs != "" && finalRemovePkgs != "" {
+		cmd = fmt.Sprintf("%s && %s", finalAddPkgs, finalRemovePkgs)
+	} else if finalAddPkgs != "" {
+		cmd = finalAddPkgs
+	} else if finalRemovePkgs != "" {
+		cmd = finalRemovePkgs
+	}
+
+	// No need to add pre/post hooks to an empty operation
+	if cmd == "" {
+		return cmd
+	}
+
+	preExec := joinHookCmds(settings.Cnf.IPkgMngPre, settings.Cnf.IPkgMngPreCmds)
+	postExec := joinHookCmds(settings.Cnf.IPkgMngPost, settings.Cnf.IPkgMngPostCmds)
+	if preExec != "" {
+		cmd = fmt.Sprintf("%s && %s", preExec, cmd)
+	}
+	if postExec != "" {
+		cmd = fmt.Sprintf("%s && %s", cmd, postExec)
+	}
+
+	return cmd
+}
+
+// joinHookCmds chains the legacy single-string hook and the hook commands
+// list, in this order, skipping empty entries
+func joinHookCmds(legacy string, cmds []string) string {
+	hooks := []string{}
+	if strings.TrimSpace(legacy) != "" {
+		hooks = append(hooks, strings.TrimSpace(legacy))
+	}
+	for _, cmd := range cmds {
+		if strings.TrimSpace(cmd) != "" {
+			hooks = append(hooks, strings.TrimSpace(cmd))
+		}
+	}
+
+	return strings.Join(hooks, " && ")
+}
+
+// HumanSummary returns a sentence describing how many packages the given
+// operation will install and remove, built from the
+// settings.Cnf.IPkgMngSummaryTemplate template and its {addCount} and
+// {removeCount} placeholders
+func (p *PackageManager) HumanSummary(operation ABSystemOperation) (string, error) {
+	PrintVerboseInfo("PackageManager.HumanSummary", "running...")
+
+	var addPkgs, removePkgs []string
+	if operation == APPLY && !settings.Cnf.IPkgMngApplyUsesCommitted {
+		upkgs, err := p.GetUnstagedPackages()
+		if err != nil {
+			PrintVerboseErr("PackageManager.HumanSummary", 0, err)
+			return "", err
+		}
+
+		for _, pkg := range resolveUnstagedPackages(upkgs) {
+			switch pkg.Status {
+			case ADD:
+				addPkgs = append(addPkgs, pkg.Name)
+			case REMOVE:
+				removePkgs = append(removePkgs, pkg.Name)
+			}
+		}
+	} else {
+		var err error
+		addPkgs, err = p.GetAddPackages()
+		if err != nil {
+			PrintVerboseErr("PackageManager.HumanSummary", 1, err)
+			return "", err
+		}
+		removePkgs, err = p.GetRemovePackages()
+		if err != nil {
+			PrintVerboseErr("PackageManager.HumanSummary", 2, err)
+			return "", err
+		}
+	}
+
+	// entries can list multiple space-separated packages
+	addCount := len(strings.Fields(strings.Join(addPkgs, " ")))
+	removeCount := len(strings.Fields(strings.Join(removePkgs, " ")))
+
+	summary := strings.NewReplacer(
+		"{addCount}", fmt.Sprint(addCount),
+		"{removeCount}", fmt.Sprint(removeCount),
+	).Replace(settings.Cnf.IPkgMngSummaryTemplate)
+
+	return summary, nil
+}
+
+// OkExitCodes returns the exit codes of the package manager commands which
+// the apply runner should treat as a success. Some package managers use
+// nonzero exit codes for benign conditions (e.g. "nothing to do")
+func (p *PackageManager) OkExitCodes() []int {
+	PrintVerboseInfo("PackageManager.OkExitCodes", "running...")
+
+	if len(settings.Cnf.IPkgMngOkExitCodes) == 0 {
+		return []int{0}
+	}
+
+	return settings.Cnf.IPkgMngOkExitCodes
+}
+
+// CheckBinariesAvailable checks that the binary each configured package
+// manager command starts with is available, either on PATH or as an existing
+// absolute path. An error is returned for every missing binary
+func (p *PackageManager) CheckBinariesAvailable() []error {
+	PrintVerboseInfo("PackageManager.CheckBinariesAvailable", "running...")
+
+	cmds := map[string]string{
+		"iPkgMngAdd":  settings.Cnf.IPkgMngAdd,
+		"iPkgMngRm":   settings.Cnf.IPkgMngRm,
+		"iPkgMngPre":  settings.Cnf.IPkgMngPre,
+		"iPkgMngPost": settings.Cnf.IPkgMngPost,
+	}
+	for i, cmd := range settings.Cnf.IPkgMngPreCmds {
+		cmds[fmt.Sprintf("iPkgMngPreCmds[%d]", i)] = cmd
+	}
+	for i, cmd := range settings.Cnf.IPkgMngPostCmds {
+		cmds[fmt.Sprintf("iPkgMngPostCmds[%d]", i)] = cmd
+	}
+
+	keys := []string{}
+	for key := range cmds {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	errs := []error{}
+	for _, key := range keys {
+		fields := strings.Fields(cmds[key])
+		if len(fields) == 0 {
+			continue
+		}
+
+		_, err := exec.LookPath(fields[0])
+		if err != nil {
+			err = fmt.Errorf("binary %s of %s is not available: %w", fields[0], key, err)
+			PrintVerboseErr("PackageManager.CheckBinariesAvailable", 0, err)
+			errs = append(errs, err)
+		}
+	}
+
+	return errs
+}
+
+// getSummarySets returns the added and removed packages listed by the
+// summary, both empty if the package manager is not usable
+func (p *PackageManager) getSummarySets() (added []string, removed []string, err error) {
+	if p.CheckStatus() != nil {
+		return []string{}, []string{}, nil
+	}
+
+	addPkgs, err := p.GetAddPackages()
+	if err != nil {
+		if errors.Is(err, &os.PathError{}) {
+			addPkgs = []string{}
+		} else {
+			return nil, nil, err
+		}
+	}
+	removePkgs, err := p.GetRemovePackages()
+	if err != nil {
+		if errors.Is(err, &os.PathError{}) {
+			removePkgs = []string{}
+		} else {
+			return nil, nil, err
+		}
+	}
+
+	// GetPackages returns slices with one empty element if there are no packages
+	if len(addPkgs) == 1 && addPkgs[0] == "" {
+		addPkgs = []string{}
+	}
+	if len(removePkgs) == 1 && removePkgs[0] == "" {
+		removePkgs = []string{}
+	}
+
+	return addPkgs, removePkgs, nil
+}
+
+func (p *PackageManager) getSummary() (string, error) {
+	addPkgs, removePkgs, err := p.getSummarySets()
+	if err != nil {
+		return "", err
+	}
+
+	summary := ""
+
+	for _, pkg := range addPkgs {
+		summary += "+ " + pkg + "\n"
+	}
+	for _, pkg := range removePkgs {
+		summary += "- " + pkg + "\n"
+	}
+
+	return summary, nil
+}
+
+// GetSummaryWithUnstaged works like the summary of WriteSummaryToFile but
+// also lists the unstaged changes, prefixed with SummaryPendingPrefix, after
+// the committed ones. Packages with a pending change are only listed as
+// pending
+func (p *PackageManager) GetSummaryWithUnstaged() (string, error) {
+	PrintVerboseInfo("PackageManager.GetSummaryWithUnstaged", "running...")
+
+	addPkgs, removePkgs, err := p.getSummarySets()
+	if err != nil {
+		PrintVerboseErr("PackageManager.GetSummaryWithUnstaged", 0, err)
+		return "", err
+	}
+
+	upkgs := []UnstagedPackage{}
+	if p.CheckStatus() == nil {
+		upkgs, err = p.GetUnstagedPackages()
+		if err != nil {
+			PrintVerboseErr("PackageManager.GetSummaryWithUnstaged", 1, err)
+			return "", err
+		}
+		upkgs = resolveUnstagedPackages(upkgs)
+	}
+
+	pending := map[string]bool{}
+	for _, upkg := range upkgs {
+		pending[packageKey(upkg.Name)] = true
+	}
+
+	summary := ""
+
+	for _, pkg := range addPkgs {
+		if !pending[packageKey(pkg)] {
+			summary += ADD + " " + pkg + "\n"
+		}
+	}
+	for _, pkg := range removePkgs {
+		if !pending[packageKey(pkg)] {
+			summary += REMOVE + " " + pkg + "\n"
+		}
+	}
+	for _, upkg := range upkgs {
+		summary += SummaryPendingPrefix + upkg.Status + " " + upkg.Name + "\n"
+	}
+
+	return summary, nil
+}
+
+// WriteSummaryToFile writes added and removed packages to summaryFilePath
+//
+// added packages get the + prefix, while removed packages get the - prefix
+func (p *PackageManager) WriteSummaryToFile(summaryFilePath string) error {
+	summary, err := p.getSummary()
+	if err != nil {
+		return err
+	}
+	if summary == "" {
+		return nil
+	}
+	summaryFile, err := os.Create(summaryFilePath)
+	if err != nil {
+		return err
+	}
+	defer summaryFile.Close()
+	err = summaryFile.Chmod(0o644)
+	if err != nil {
+		return err
+	}
+	_, err = summaryFile.WriteString(summary)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetSummaryStruct returns the added and removed packages summarized by
+// WriteSummaryToFile, along with their counts
+func (p *PackageManager) GetSummaryStruct() (*Summary, error) {
+	PrintVerboseInfo("PackageManager.GetSummaryStruct", "running...")
+
+	addPkgs, removePkgs, err := p.getSummarySets()
+	if err != nil {
+		PrintVerboseErr("PackageManager.GetSummaryStruct", 0, err)
+		return nil, err
+	}
+
+	return &Summary{
+		Added:        addPkgs,
+		Removed:      removePkgs,
+		AddedCount:   len(addPkgs),
+		RemovedCount: len(removePkgs),
+	}, nil
+}
+
+// WriteSummaryJSON works like WriteSummaryToFile but writes the summary as
+// JSON, see Summary. Unlike WriteSummaryToFile, the file is written even if
+// there are no packages, so the counts can always be read
+func (p *PackageManager) WriteSummaryJSON(summaryFilePath string) error {
+	PrintVerboseInfo("PackageManager.WriteSummaryJSON", "running...")
+
+	summary, err := p.GetSummaryStruct()
+	if err != nil {
+		PrintVerboseErr("PackageManager.WriteSummaryJSON", 0, err)
+		return err
+	}
+
+	content, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		PrintVerboseErr("PackageManager.WriteSummaryJSON", 1, err)
+		return err
+	}
+
+	err = os.WriteFile(summaryFilePath, append(content, '\n'), 0o644)
+	if err != nil {
+		PrintVerboseErr("PackageManager.WriteSummaryJSON", 2, err)
+		return err
+	}
+
+	return nil
+}
+
+// assertPkgMngApiSetUp checks whether the repo API is properly configured.
+// If a configuration exists but is malformed, returns an error.
+func assertPkgMngApiSetUp() (bool, error) {
+	if settings.Cnf.IPkgMngApi == "" {
+		PrintVerboseInfo("PackageManager.assertPkgMngApiSetUp", "no API url set, will not check if package exists. This could lead to errors")
+		return false, nil
+	}
+
+	_, err := url.ParseRequestURI(settings.Cnf.IPkgMngApi)
+	if err != nil {
+		return false, fmt.Errorf("PackageManager.assertPkgMngApiSetUp: Value set as API url (%s) is not a valid URL", settings.Cnf.IPkgMngApi)
+	}
+
+	if !strings.Contains(settings.Cnf.IPkgMngApi, "{packageName}") {
+		return false, fmt.Errorf("PackageManager.assertPkgMngApiSetUp: API url does not contain {packageName} placeholder. ABRoot is probably misconfigured, please report the issue to the maintainers of the distribution")
+	}
+
+	for _, fallback := range settings.Cnf.IPkgMngApiFallbacks {
+		_, err = url.ParseRequestURI(fallback)
+		if err != nil || !strings.Contains(fallback, "{packageName}") {
+			return false, fmt.Errorf("PackageManager.assertPkgMngApiSetUp: Value set as fallback API url (%s) is not a valid URL with the {packageName} placeholder", fallback)
+		}
+	}
+
+	apiUrls := strings.Join(slices.Concat([]string{settings.Cnf.IPkgMngApi}, settings.Cnf.IPkgMngApiFallbacks), " ")
+	if strings.Contains(apiUrls, "{branch}") && settings.Cnf.IPkgMngBranch == "" {
+		return false, fmt.Errorf("PackageManager.assertPkgMngApiSetUp: API url contains the {branch} placeholder but no branch is set. ABRoot is probably misconfigured, please report the issue to the maintainers of the distribution")
+	}
+	if strings.Contains(apiUrls, "{release}") && settings.Cnf.IPkgMngRelease == "" {
+		return false, fmt.Errorf("PackageManager.assertPkgMngApiSetUp: API url contains the {release} placeholder but no release is set. ABRoot is probably misconfigured, please report the issue to the maintainers of the distribution")
+	}
+
+	PrintVerboseInfo("PackageManager.assertPkgMngApiSetUp", "Repo is set up properly")
+	return true, nil
+}
+
+// repoURLsForPkg fills the placeholders of the repo API url and of its
+// fallbacks for the given package and branch, in the order they are tried.
+// The {arch} placeholder defaults to the running architecture
+func repoURLsForPkg(pkg, branch string) []string {
+	arch := settings.Cnf.IPkgMngArch
+	if arch == "" {
+		arch = runtime.GOARCH
+	}
+
+	replacer := strings.NewReplacer(
+		"{packageName}", pkg,
+		"{branch}", branch,
+		"{arch}", arch,
+		"{release}", settings.Cnf.IPkgMngRelease,
+	)
+
+	urls := []string{replacer.Replace(settings.Cnf.IPkgMngApi)}
+	for _, fallback := range settings.Cnf.IPkgMngApiFallbacks {
+		urls = append(urls, replacer.Replace(fallback))
+	}
+
+	return urls
+}
+
+// repoTryNext reports whether the next repo mirror should be queried after
+// the given answer: it is when the request failed, the mirror had a server
+// error, or it does not have the package and IPkgMngApiFallbackOn404 is set
+func repoTryNext(status int, err error) bool {
+	if err != nil || status >= 500 || repoStatusRejected(status) {
+		return true
+	}
+
+	return !repoStatusExists(status) && settings.Cnf.IPkgMngApiFallbackOn404
+}
+
+func (p *PackageManager) ExistsInRepo(pkg string) error {
+	return p.ExistsInRepoCtx(context.Background(), pkg)
+}
+
+// ExistsInRepoCtx works like ExistsInRepo but the repo requests are bound to
+// the given context, cancelling it aborts the requests in flight. Backends
+// are not given the context, see Backend
+func (p *PackageManager) ExistsInRepoCtx(ctx context.Context, pkg string) error {
+	PrintVerboseInfo("PackageManager.ExistsInRepo", "running...")
+	_, err := p.existsInRepo(ctx, pkg)
+	return err
+}
+
+// ExistsInRepoBranch works like ExistsInRepo but checks the availability
+// of the package in the given branch instead of the configured one. The
+// API url must contain the {branch} placeholder
+func (p *PackageManager) ExistsInRepoBranch(pkg, branch string) error {
+	PrintVerboseInfo("PackageManager.ExistsInRepoBranch", "running...")
+
+	if !strings.Contains(settings.Cnf.IPkgMngApi, "{branch}") {
+		return errors.New("PackageManager.ExistsInRepoBranch: API url does not contain the {branch} placeholder, cannot check a specific branch")
+	}
+
+	_, err := p.existsInRepoBranch(context.Background(), pkg, branch)
+	return err
+}
+
+// existsInRepo works like ExistsInRepo but also returns the status code
+// of the repo response, 0 if no response was received
+func (p *PackageManager) existsInRepo(ctx context.Context, pkg string) (int, error) {
+	return p.existsInRepoBranch(ctx, pkg, settings.Cnf.IPkgMngBranch)
+}
+
+func (p *PackageManager) existsInRepoBranch(ctx context.Context, pkg, branch string) (int, error) {
+	if p.offline {
+		PrintVerboseWarn("PackageManager.ExistsInRepo", 0, "offline mode, skipping the repo check for", pkg)
+		return 0, nil
+	}
+
+	// backends have no notion of branches nor status codes
+	if p.backend != nil && branch == settings.Cnf.IPkgMngBranch {
+		PrintVerboseInfo("PackageManager.ExistsInRepo", "checking if package exists with the backend: "+pkg)
+		return 0, p.backend.ExistsInRepo(pkg)
+	}
+
+	return p.existsInRepoAPI(ctx, pkg, branch)
+}
+
+// existsInRepoAPI checks if a package exists in the given branch of the repo
+// API, trying the mirrors in order
+func (p *PackageManager) existsInRepoAPI(ctx context.Context, pkg, branch string) (int, error) {
+	ok, err := assertPkgMngApiSetUp()
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, nil
+	}
+
+	// mirrors are tried in order until one gives a definitive answer, a
+	// missing package is reported over the errors of the other mirrors
+	var notFound error
+	var notFoundStatus int
+	urls := repoURLsForPkg(pkg, branch)
+	for i, url := range urls {
+		status, err := p.existsAtURL(ctx, pkg, url)
+		if err == nil {
+			return status, nil
+		}
+
+		// a mirror answering with a non-JSON page is misconfigured, the
+		// next one is tried as for a network error
+		var errNotFound *ErrPackageNotFound
+		tryNext := true
+		if errors.As(err, &errNotFound) && errNotFound.Reason == "" {
+			tryNext = repoTryNext(status, nil)
+			if status < 500 && notFound == nil {
+				notFound, notFoundStatus = err, status
+			}
+		}
+		if i == len(urls)-1 || !tryNext {
+			if notFound != nil {
+				return notFoundStatus, notFound
+			}
+			return status, err
+		}
+
+		PrintVerboseWarn("PackageManager.ExistsInRepo", 2, "no definitive answer from", url, "trying the next mirror")
+	}
+
+	return 0, nil
+}
+
+// repoStatusRejected reports whether a repo API status code means that the
+// request was refused rather than answered, see ErrRepoRejected
+func repoStatusRejected(status int) bool {
+	return status == http.StatusUnauthorized || status == http.StatusForbidden || status == http.StatusTooManyRequests
+}
+
+// repoStatusCacheable reports whether a repo API status code is a definitive
+// answer about the package, which can be cached
+func repoStatusCacheable(status int) bool {
+	return repoStatusExists(status) || status == http.StatusNotFound || status == http.StatusGone
+}
+
+// repoStatusExists reports whether a repo API status code means that the
+// package exists, according to IPkgMngApiSuccessCodes. Server errors never
+// do, whatever the setting
+func repoStatusExists(status int) bool {
+	if status >= 500 {
+		return false
+	}
+	if len(settings.Cnf.IPkgMngApiSuccessCodes) == 0 {
+		return status == 200
+	}
+
+	return slices.Contains(settings.Cnf.IPkgMngApiSuccessCodes, status)
+}
 
-		_, err = fmt.Fprintf(f, "%s\n", pkg)
-		if err != nil {
-			PrintVerboseErr("PackageManager.writePackages", 1, err)
-			return err
+// existsAtURL checks if a package exists at the given repo API url
+func (p *PackageManager) existsAtURL(ctx context.Context, pkg, url string) (int, error) {
+	status, cached := p.repoCache.get(url)
+	if cached {
+		PrintVerboseInfo("PackageManager.ExistsInRepo", "using cached repo response for: "+url)
+		p.trace("repo-check", pkg, status)
+		if !repoStatusExists(status) {
+			return status, &ErrPackageNotFound{Package: pkg, Status: status}
 		}
+		return status, nil
 	}
 
-	PrintVerboseInfo("PackageManager.writePackages", "packages written")
-	return nil
+	// concurrent checks of the same url share a single request. It is not
+	// bound to the cancellation of the first caller, which would fail the
+	// others, each caller gives up on its own context instead
+	flight := p.repoFlight.DoChan(url, func() (interface{}, error) {
+		status, err := p.queryURL(context.WithoutCancel(ctx), pkg, url)
+		return status, err
+	})
+
+	select {
+	case res := <-flight:
+		return res.Val.(int), res.Err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
 }
 
-func (p *PackageManager) processApplyPackages() (string, string) {
-	PrintVerboseInfo("PackageManager.processApplyPackages", "running...")
+// queryURL queries the given repo API url for a package, caching the answer
+func (p *PackageManager) queryURL(ctx context.Context, pkg, url string) (int, error) {
+	PrintVerboseInfo("PackageManager.ExistsInRepo", "checking if package exists in repo: "+url)
 
-	unstaged, err := p.GetUnstagedPackages()
+	// only the status code matters, HEAD avoids downloading the body
+	resp, err := repoHead(ctx, p.client(), url)
 	if err != nil {
-		PrintVerboseErr("PackageManager.processApplyPackages", 0, err)
+		PrintVerboseErr("PackageManager.ExistsInRepo", 0, err)
+		p.trace("repo-check", pkg, err)
+		return 0, err
 	}
+	// the body is drained so that the connection can be reused
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	p.trace("repo-check", pkg, resp.StatusCode)
 
-	var addPkgs, removePkgs []string
-	for _, pkg := range unstaged {
-		switch pkg.Status {
-		case ADD:
-			addPkgs = append(addPkgs, pkg.Name)
-		case REMOVE:
-			removePkgs = append(removePkgs, pkg.Name)
-		}
+	if repoStatusRejected(resp.StatusCode) {
+		err = &ErrRepoRejected{pkg, resp.StatusCode}
+		PrintVerboseErr("PackageManager.ExistsInRepo", 0.5, err)
+		return resp.StatusCode, err
 	}
 
-	finalAddPkgs := ""
-	if len(addPkgs) > 0 {
-		finalAddPkgs = fmt.Sprintf("%s %s", settings.Cnf.IPkgMngAdd, strings.Join(addPkgs, " "))
+	// misconfigured mirrors may answer with an HTML error page, such
+	// responses are not cached since the mirror may get fixed
+	if resp.StatusCode == 200 && settings.Cnf.IPkgMngApiExpectJSON && !isJSONResponse(resp) {
+		err = &ErrPackageNotFound{
+			Package: pkg,
+			Status:  resp.StatusCode,
+			Reason:  fmt.Sprintf("the repo answered with a non-JSON response (%s), check the iPkgMngApi setting", resp.Header.Get("Content-Type")),
+		}
+		PrintVerboseErr("PackageManager.ExistsInRepo", 1, err)
+		return resp.StatusCode, err
 	}
+	p.repoCache.set(url, resp.StatusCode)
 
-	finalRemovePkgs := ""
-	if len(removePkgs) > 0 {
-		finalRemovePkgs = fmt.Sprintf("%s %s", settings.Cnf.IPkgMngRm, strings.Join(removePkgs, " "))
+	if !repoStatusExists(resp.StatusCode) {
+		PrintVerboseInfo("PackageManager.ExistsInRepo", "package does not exist in repo")
+		return resp.StatusCode, &ErrPackageNotFound{Package: pkg, Status: resp.StatusCode}
 	}
 
-	return finalAddPkgs, finalRemovePkgs
+	PrintVerboseInfo("PackageManager.ExistsInRepo", "package exists in repo")
+	return resp.StatusCode, nil
 }
 
-func (p *PackageManager) processUpgradePackages() (string, string) {
-	addPkgs, err := p.GetAddPackagesString(" ")
-	if err != nil {
-		PrintVerboseErr("PackageManager.processUpgradePackages", 0, err)
-		return "", ""
+// validateInRepo checks if the given packages exist in the repo, unless
+// validation is suspended, in which case they are queued for RevalidateAll
+func (p *PackageManager) validateInRepo(ctx context.Context, pkgs ...string) error {
+	if p.validationSuspended {
+		PrintVerboseInfo("PackageManager.validateInRepo", "validation suspended, deferring check for", pkgs)
+		p.resultsMutex.Lock()
+		p.pendingValidation = append(p.pendingValidation, pkgs...)
+		p.resultsMutex.Unlock()
+		return nil
 	}
 
-	removePkgs, err := p.GetRemovePackagesString(" ")
-	if err != nil {
-		PrintVerboseErr("PackageManager.processUpgradePackages", 1, err)
-		return "", ""
-	}
+	return errors.Join(p.checkPackagesInRepo(ctx, pkgs)...)
+}
 
-	if len(addPkgs) == 0 && len(removePkgs) == 0 {
-		PrintVerboseInfo("PackageManager.processUpgradePackages", "no packages to install or remove")
-		return "", ""
-	}
+// checkPackagesInRepo checks every given package in the repo, returning an
+// error for each package which failed the check. The failures are recorded
+// and can be retrieved with LastFailedPackages
+func (p *PackageManager) checkPackagesInRepo(ctx context.Context, pkgs []string) []error {
+	// the checks run concurrently, results are collected by index so that
+	// the failures are reported in the order of the packages
+	statuses := make([]int, len(pkgs))
+	results := make([]error, len(pkgs))
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, repoCheckWorkers)
+	for i, pkg := range pkgs {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(i int, pkg string) {
+			defer wg.Done()
+			defer func() { <-slots }()
 
-	finalAddPkgs := ""
-	if addPkgs != "" {
-		finalAddPkgs = fmt.Sprintf("%s %s", settings.Cnf.IPkgMngAdd, addPkgs)
+			statuses[i], results[i] = p.existsInRepo(ctx, pkg)
+		}(i, pkg)
 	}
+	wg.Wait()
 
-	finalRemovePkgs := ""
-	if removePkgs != "" {
-		finalRemovePkgs = fmt.Sprintf("%s %s", settings.Cnf.IPkgMngRm, removePkgs)
+	errs := []error{}
+	failed := []FailedPackage{}
+	for i, err := range results {
+		if err != nil {
+			PrintVerboseErr("PackageManager.checkPackagesInRepo", 0, err)
+			errs = append(errs, err)
+			failed = append(failed, FailedPackage{pkgs[i], err.Error(), statuses[i]})
+		}
 	}
 
-	return finalAddPkgs, finalRemovePkgs
+	p.resultsMutex.Lock()
+	p.lastFailed = failed
+	p.resultsMutex.Unlock()
+
+	return errs
 }
 
-func (p *PackageManager) GetFinalCmd(operation ABSystemOperation) string {
-	PrintVerboseInfo("PackageManager.GetFinalCmd", "running...")
+// LastFailedPackages returns the packages which failed the repo check
+// during the last batch operation, this is only kept in memory
+func (p *PackageManager) LastFailedPackages() []FailedPackage {
+	PrintVerboseInfo("PackageManager.LastFailedPackages", "running...")
 
-	var finalAddPkgs, finalRemovePkgs string
-	if operation == APPLY {
-		finalAddPkgs, finalRemovePkgs = p.processApplyPackages()
-	} else {
-		finalAddPkgs, finalRemovePkgs = p.processUpgradePackages()
-	}
+	p.resultsMutex.Lock()
+	defer p.resultsMutex.Unlock()
+	return p.lastFailed
+}
 
-	cmd := ""
-	if finalAddPkgs != "" && finalRemovePkgs != "" {
-		cmd = fmt.Sprintf("%s && %s", finalAddPkgs, finalRemovePkgs)
-	} else if finalAddPkgs != "" {
-		cmd = finalAddPkgs
-	} else if finalRemovePkgs != "" {
-		cmd = finalRemovePkgs
-	}
+// SuspendValidation makes Add and Remove skip the repo checks until
+// ResumeValidation is called. This is useful to stage many packages quickly
+// and validate them all at once with RevalidateAll
+func (p *PackageManager) SuspendValidation() {
+	PrintVerboseInfo("PackageManager.SuspendValidation", "running...")
+	p.validationSuspended = true
+}
 
-	// No need to add pre/post hooks to an empty operation
-	if cmd == "" {
-		return cmd
-	}
+// ResumeValidation makes Add and Remove check packages in the repo again,
+// packages staged while validation was suspended are not checked until
+// RevalidateAll is called
+func (p *PackageManager) ResumeValidation() {
+	PrintVerboseInfo("PackageManager.ResumeValidation", "running...")
+	p.validationSuspended = false
+}
 
-	preExec := settings.Cnf.IPkgMngPre
-	postExec := settings.Cnf.IPkgMngPost
-	if preExec != "" {
-		cmd = fmt.Sprintf("%s && %s", preExec, cmd)
-	}
-	if postExec != "" {
-		cmd = fmt.Sprintf("%s && %s", cmd, postExec)
-	}
+// RevalidateAll checks in the repo every package staged while validation was
+// suspended, returning an error for each package which failed the check. The
+// checks share the retry budget of the batch operations, see AddMany
+func (p *PackageManager) RevalidateAll() []error {
+	PrintVerboseInfo("PackageManager.RevalidateAll", "running...")
 
-	PrintVerboseInfo("PackageManager.GetFinalCmd", "returning cmd: "+cmd)
-	return cmd
+	p.resultsMutex.Lock()
+	pending := p.pendingValidation
+	p.pendingValidation = nil
+	p.resultsMutex.Unlock()
+
+	return p.checkPackagesInRepo(withRetryBudget(context.Background()), pending)
 }
 
-func (p *PackageManager) getSummary() (string, error) {
-	if p.CheckStatus() != nil {
-		return "", nil
-	}
+// GetRepoContentsForPkg retrieves package information from the repository API
+func GetRepoContentsForPkg(pkg string) (map[string]interface{}, error) {
+	PrintVerboseInfo("PackageManager.GetRepoContentsForPkg", "running...")
 
-	addPkgs, err := p.GetAddPackages()
-	if err != nil {
-		if errors.Is(err, &os.PathError{}) {
-			addPkgs = []string{}
-		} else {
-			return "", err
-		}
-	}
-	removePkgs, err := p.GetRemovePackages()
+	pkgInfo := map[string]interface{}{}
+	err := fetchRepoContents(context.Background(), repoHTTPClient(), pkg, &pkgInfo)
 	if err != nil {
-		if errors.Is(err, &os.PathError{}) {
-			removePkgs = []string{}
-		} else {
-			return "", err
-		}
+		PrintVerboseErr("PackageManager.GetRepoContentsForPkg", 0, err)
+		return map[string]interface{}{}, err
 	}
 
-	// GetPackages returns slices with one empty element if there are no packages
-	if len(addPkgs) == 1 && addPkgs[0] == "" {
-		addPkgs = []string{}
-	}
-	if len(removePkgs) == 1 && removePkgs[0] == "" {
-		removePkgs = []string{}
-	}
+	return pkgInfo, nil
+}
 
-	summary := ""
+// GetRepoContentsForPkg retrieves package information from the repository
+// API through the client of the package manager, see SetRepoClient
+func (p *PackageManager) GetRepoContentsForPkg(pkg string) (map[string]interface{}, error) {
+	return p.GetRepoContentsForPkgCtx(context.Background(), pkg)
+}
 
-	for _, pkg := range addPkgs {
-		summary += "+ " + pkg + "\n"
-	}
-	for _, pkg := range removePkgs {
-		summary += "- " + pkg + "\n"
+// GetRepoContentsForPkgCtx works like GetRepoContentsForPkg but the repo
+// requests are bound to the given context, cancelling it aborts the requests
+// in flight
+func (p *PackageManager) GetRepoContentsForPkgCtx(ctx context.Context, pkg string) (map[string]interface{}, error) {
+	PrintVerboseInfo("PackageManager.GetRepoContentsForPkg", "running...")
+
+	pkgInfo := map[string]interface{}{}
+	err := fetchRepoContents(ctx, p.client(), pkg, &pkgInfo)
+	if err != nil {
+		PrintVerboseErr("PackageManager.GetRepoContentsForPkg", 0, err)
+		return map[string]interface{}{}, err
 	}
 
-	return summary, nil
+	return pkgInfo, nil
 }
 
-// WriteSummaryToFile writes added and removed packages to summaryFilePath
-//
-// added packages get the + prefix, while removed packages get the - prefix
-func (p *PackageManager) WriteSummaryToFile(summaryFilePath string) error {
-	summary, err := p.getSummary()
-	if err != nil {
-		return err
-	}
-	if summary == "" {
-		return nil
-	}
-	summaryFile, err := os.Create(summaryFilePath)
-	if err != nil {
-		return err
-	}
-	defer summaryFile.Close()
-	err = summaryFile.Chmod(0o644)
+// GetPackageInfo retrieves package information from the repository API, as
+// a PackageInfo struct. Fields the API does not provide are left empty,
+// while fields it provides but PackageInfo does not know are ignored
+func (p *PackageManager) GetPackageInfo(pkg string) (*PackageInfo, error) {
+	PrintVerboseInfo("PackageManager.GetPackageInfo", "running...")
+	return p.getPackageInfo(context.Background(), pkg)
+}
+
+// getPackageInfo implements GetPackageInfo, the repo requests are bound to
+// the given context
+func (p *PackageManager) getPackageInfo(ctx context.Context, pkg string) (*PackageInfo, error) {
+	pkgInfo := &PackageInfo{}
+	err := fetchRepoContents(ctx, p.client(), pkg, pkgInfo)
 	if err != nil {
-		return err
+		PrintVerboseErr("PackageManager.GetPackageInfo", 0, err)
+		return nil, err
 	}
-	_, err = summaryFile.WriteString(summary)
+
+	return pkgInfo, nil
+}
+
+// PackageOrigin returns who maintains a package and where it comes from, as
+// reported by the repository API. The result is not available if the API
+// provides neither
+func (p *PackageManager) PackageOrigin(pkg string) (Origin, error) {
+	PrintVerboseInfo("PackageManager.PackageOrigin", "running...")
+
+	pkgInfo, err := p.GetPackageInfo(pkg)
 	if err != nil {
-		return err
+		PrintVerboseErr("PackageManager.PackageOrigin", 0, err)
+		return Origin{}, err
 	}
 
-	return nil
+	return Origin{
+		Maintainer: pkgInfo.Maintainer,
+		Origin:     pkgInfo.Origin,
+		Available:  pkgInfo.Maintainer != "" || pkgInfo.Origin != "",
+	}, nil
 }
 
-// assertPkgMngApiSetUp checks whether the repo API is properly configured.
-// If a configuration exists but is malformed, returns an error.
-func assertPkgMngApiSetUp() (bool, error) {
-	if settings.Cnf.IPkgMngApi == "" {
-		PrintVerboseInfo("PackageManager.assertPkgMngApiSetUp", "no API url set, will not check if package exists. This could lead to errors")
-		return false, nil
-	}
+// ErrIncompleteEstimate is returned by EstimateDuration along with a partial
+// estimate when the install time of some packages is unknown
+var ErrIncompleteEstimate = errors.New("incomplete install time data")
 
-	_, err := url.ParseRequestURI(settings.Cnf.IPkgMngApi)
-	if err != nil {
-		return false, fmt.Errorf("PackageManager.assertPkgMngApiSetUp: Value set as API url (%s) is not a valid URL", settings.Cnf.IPkgMngApi)
+// EstimateDuration sums the install times the repository API advertises for
+// the given packages. If some are unknown, the estimate of the others is
+// returned along with an error wrapping ErrIncompleteEstimate
+func (p *PackageManager) EstimateDuration(pkgs []string) (time.Duration, error) {
+	PrintVerboseInfo("PackageManager.EstimateDuration", "running...")
+
+	var total time.Duration
+	missing := []string{}
+	for _, name := range packageNames(pkgs) {
+		pkgInfo, err := p.GetPackageInfo(name)
+		if err != nil || pkgInfo.InstallTime <= 0 {
+			missing = append(missing, name)
+			continue
+		}
+
+		total += time.Duration(pkgInfo.InstallTime * float64(time.Second))
 	}
 
-	if !strings.Contains(settings.Cnf.IPkgMngApi, "{packageName}") {
-		return false, fmt.Errorf("PackageManager.assertPkgMngApiSetUp: API url does not contain {packageName} placeholder. ABRoot is probably misconfigured, please report the issue to the maintainers of the distribution")
+	if len(missing) > 0 {
+		err := fmt.Errorf("%w, unknown for: %s", ErrIncompleteEstimate, strings.Join(missing, ", "))
+		PrintVerboseWarn("PackageManager.EstimateDuration", 0, err)
+		return total, err
 	}
 
-	PrintVerboseInfo("PackageManager.assertPkgMngApiSetUp", "Repo is set up properly")
-	return true, nil
+	return total, nil
 }
 
-func (p *PackageManager) ExistsInRepo(pkg string) error {
-	PrintVerboseInfo("PackageManager.ExistsInRepo", "running...")
-
+// fetchRepoContents queries the repository API for a package through the
+// given client, unmarshaling the response into v
+func fetchRepoContents(ctx context.Context, client RepoClient, pkg string, v interface{}) error {
 	ok, err := assertPkgMngApiSetUp()
 	if err != nil {
 		return err
 	}
 	if !ok {
-		return nil
+		return errors.New("PackageManager.fetchRepoContents: no API url set, cannot query package information")
 	}
 
-	url := strings.Replace(settings.Cnf.IPkgMngApi, "{packageName}", pkg, 1)
-	PrintVerboseInfo("PackageManager.ExistsInRepo", "checking if package exists in repo: "+url)
+	// mirrors are tried in order until one gives a definitive answer, the
+	// same way as in existsInRepoAPI
+	var notFound error
+	urls := repoURLsForPkg(pkg, settings.Cnf.IPkgMngBranch)
+	for i, url := range urls {
+		PrintVerboseInfo("PackageManager.fetchRepoContents", "fetching package information in: "+url)
+		last := i == len(urls)-1
 
-	resp, err := http.Get(url)
-	if err != nil {
-		PrintVerboseErr("PackageManager.ExistsInRepo", 0, err)
-		return err
-	}
+		resp, err := repoGet(ctx, client, url)
+		if err != nil {
+			if last {
+				if notFound != nil {
+					return notFound
+				}
+				PrintVerboseErr("PackageManager.fetchRepoContents", 0, err)
+				return err
+			}
+			PrintVerboseWarn("PackageManager.fetchRepoContents", 0, "no answer from", url, "trying the next mirror")
+			continue
+		}
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			defer resp.Body.Close()
+			return decodeRepoContents(resp, pkg, v)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		PrintVerboseInfo("PackageManager.ExistsInRepo", "package does not exist in repo")
-		return fmt.Errorf("package does not exist in repo: %s", pkg)
+		switch {
+		case repoStatusRejected(resp.StatusCode):
+			err = &ErrRepoRejected{pkg, resp.StatusCode}
+		case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+			err = &ErrPackageNotFound{Package: pkg, Status: resp.StatusCode}
+			if notFound == nil {
+				notFound = err
+			}
+		default:
+			err = fmt.Errorf("the repo answered to the query for %s with the status %d", pkg, resp.StatusCode)
+		}
+		if last || !repoTryNext(resp.StatusCode, nil) {
+			if notFound != nil {
+				err = notFound
+			}
+			PrintVerboseErr("PackageManager.fetchRepoContents", 0.2, err)
+			return err
+		}
+
+		PrintVerboseWarn("PackageManager.fetchRepoContents", 0.1, "no definitive answer from", url, "trying the next mirror")
 	}
 
-	PrintVerboseInfo("PackageManager.ExistsInRepo", "package exists in repo")
 	return nil
 }
 
-// GetRepoContentsForPkg retrieves package information from the repository API
-func GetRepoContentsForPkg(pkg string) (map[string]interface{}, error) {
-	PrintVerboseInfo("PackageManager.GetRepoContentsForPkg", "running...")
+// decodeRepoContents decodes the body of a repo API response into v
+func decodeRepoContents(resp *http.Response, pkg string, v interface{}) error {
+	if settings.Cnf.IPkgMngApiExpectJSON && !isJSONResponse(resp) {
+		err := fmt.Errorf("the repo answered to the query for %s with a non-JSON response (%s), check the iPkgMngApi setting", pkg, resp.Header.Get("Content-Type"))
+		PrintVerboseErr("PackageManager.fetchRepoContents", 0.1, err)
+		return err
+	}
 
-	ok, err := assertPkgMngApiSetUp()
+	contents, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return map[string]interface{}{}, err
+		PrintVerboseErr("PackageManager.fetchRepoContents", 1, err)
+		return err
 	}
-	if !ok {
-		return map[string]interface{}{}, errors.New("PackageManager.GetRepoContentsForPkg: no API url set, cannot query package information")
+
+	err = json.Unmarshal(contents, v)
+	if err != nil {
+		PrintVerboseErr("PackageManager.fetchRepoContents", 2, err)
+		snippet := string(contents)
+		if len(snippet) > repoResponseSnippetLen {
+			snippet = snippet[:repoResponseSnippetLen]
+		}
+		return &ErrMalformedRepoResponse{pkg, snippet, err}
 	}
 
-	url := strings.Replace(settings.Cnf.IPkgMngApi, "{packageName}", pkg, 1)
-	PrintVerboseInfo("PackageManager.GetRepoContentsForPkg", "fetching package information in: "+url)
+	return nil
+}
+
+// userAgreementRecord is the content of the user agreement file. Version is
+// the policy version the user accepted, while RequiredVersion is bumped by
+// RequireReacceptance to force a new acceptance regardless of the settings
+type userAgreementRecord struct {
+	Timestamp       time.Time `json:"timestamp"`
+	Version         int       `json:"version"`
+	RequiredVersion int       `json:"requiredVersion,omitempty"`
+}
+
+// userAgreementFile returns the path of the user agreement file, which lives
+// in the package manager base directory
+func (p *PackageManager) userAgreementFile() string {
+	return filepath.Join(p.baseDir, filepath.Base(PkgManagerUserAgreementFile))
+}
 
-	resp, err := http.Get(url)
+// readUserAgreement reads the user agreement record. Agreements accepted
+// before records were versioned only contain a timestamp and are read as
+// version 0
+func (p *PackageManager) readUserAgreement() (*userAgreementRecord, error) {
+	content, err := os.ReadFile(p.userAgreementFile())
 	if err != nil {
-		PrintVerboseErr("PackageManager.GetRepoContentsForPkg", 0, err)
-		return map[string]interface{}{}, err
+		return nil, err
 	}
 
-	contents, err := io.ReadAll(resp.Body)
+	record := &userAgreementRecord{}
+	err = json.Unmarshal(content, record)
 	if err != nil {
-		PrintVerboseErr("PackageManager.GetRepoContentsForPkg", 1, err)
-		return map[string]interface{}{}, err
+		PrintVerboseInfo("PackageManager.readUserAgreement", "legacy agreement record found")
+		return &userAgreementRecord{}, nil
 	}
 
-	pkgInfo := map[string]interface{}{}
-	err = json.Unmarshal(contents, &pkgInfo)
+	return record, nil
+}
+
+func (p *PackageManager) writeUserAgreement(record *userAgreementRecord) error {
+	content, err := json.Marshal(record)
 	if err != nil {
-		PrintVerboseErr("PackageManager.GetRepoContentsForPkg", 2, err)
-		return map[string]interface{}{}, err
+		return err
 	}
 
-	return pkgInfo, nil
+	return os.WriteFile(p.userAgreementFile(), content, 0o644)
+}
+
+// requiredAgreementVersion returns the minimum policy version the user must
+// have accepted, given the settings and the stored requirement
+func requiredAgreementVersion(record *userAgreementRecord) int {
+	required := settings.Cnf.IPkgMngAgreementVersion
+	if record != nil && record.RequiredVersion > required {
+		required = record.RequiredVersion
+	}
+
+	return required
 }
 
 // AcceptUserAgreement sets the package manager status to enabled
@@ -732,11 +3986,11 @@ func (p *PackageManager) AcceptUserAgreement() error {
 		return nil
 	}
 
-	err := os.WriteFile(
-		PkgManagerUserAgreementFile,
-		[]byte(time.Now().String()),
-		0o644,
-	)
+	previous, _ := p.readUserAgreement()
+	err := p.writeUserAgreement(&userAgreementRecord{
+		Timestamp: time.Now(),
+		Version:   requiredAgreementVersion(previous),
+	})
 	if err != nil {
 		PrintVerboseErr("PackageManager.AcceptUserAgreement", 0, err)
 		return err
@@ -745,8 +3999,77 @@ func (p *PackageManager) AcceptUserAgreement() error {
 	return nil
 }
 
+// RequireReacceptance invalidates the current user agreement, forcing the
+// user to accept it again even if the policy version did not change
+func (p *PackageManager) RequireReacceptance() error {
+	PrintVerboseInfo("PackageManager.RequireReacceptance", "running...")
+
+	record, err := p.readUserAgreement()
+	if err != nil {
+		PrintVerboseInfo("PackageManager.RequireReacceptance", "agreement not accepted yet, nothing to do")
+		return nil
+	}
+
+	required := requiredAgreementVersion(record)
+	if record.Version > required {
+		required = record.Version
+	}
+	record.RequiredVersion = required + 1
+
+	err = p.writeUserAgreement(record)
+	if err != nil {
+		PrintVerboseErr("PackageManager.RequireReacceptance", 0, err)
+		return err
+	}
+
+	return nil
+}
+
+// RevokeAgreement withdraws the user agreement by removing its file, so that
+// the user has to accept it again, e.g. when re-provisioning the system.
+// The package manager status is derived from the settings and stays in
+// agreement mode, only the acceptance is reset. Revoking an agreement which
+// was never accepted is not an error
+func (p *PackageManager) RevokeAgreement() error {
+	PrintVerboseInfo("PackageManager.RevokeAgreement", "running...")
+
+	err := os.Remove(p.userAgreementFile())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		PrintVerboseErr("PackageManager.RevokeAgreement", 0, err)
+		return err
+	}
+
+	return nil
+}
+
+// GetAgreementTimestamp returns when the user accepted the agreement. For
+// legacy agreement records, which do not store it, the modification time of
+// the agreement file is returned. It fails if the agreement was not accepted
+func (p *PackageManager) GetAgreementTimestamp() (time.Time, error) {
+	PrintVerboseInfo("PackageManager.GetAgreementTimestamp", "running...")
+
+	record, err := p.readUserAgreement()
+	if err != nil {
+		PrintVerboseErr("PackageManager.GetAgreementTimestamp", 0, err)
+		return time.Time{}, err
+	}
+	if !record.Timestamp.IsZero() {
+		return record.Timestamp, nil
+	}
+
+	info, err := os.Stat(p.userAgreementFile())
+	if err != nil {
+		PrintVerboseErr("PackageManager.GetAgreementTimestamp", 1, err)
+		return time.Time{}, err
+	}
+
+	return info.ModTime(), nil
+}
+
 // GetUserAgreementStatus returns if the user has accepted the package manager
-// agreement or not
+// agreement or not. An agreement accepted for an older policy version than
+// settings.Cnf.IPkgMngAgreementVersion is considered not accepted. The
+// admin agreement policy, if any, takes precedence over the local decision
 func (p *PackageManager) GetUserAgreementStatus() bool {
 	PrintVerboseInfo("PackageManager.GetUserAgreementStatus", "running...")
 
@@ -755,17 +4078,40 @@ func (p *PackageManager) GetUserAgreementStatus() bool {
 		return true
 	}
 
-	_, err := os.Stat(PkgManagerUserAgreementFile)
+	// a broken policy is ignored rather than locking every user out
+	policy, err := readAgreementPolicy()
+	if err != nil {
+		PrintVerboseWarn("PackageManager.GetUserAgreementStatus", 0, "ignoring the agreement policy:", err)
+	}
+	if policy != nil && policy.Agreement == AgreementPolicyAccepted {
+		PrintVerboseInfo("PackageManager.GetUserAgreementStatus", "agreement accepted by the policy")
+		return true
+	}
+
+	record, err := p.readUserAgreement()
 	if err != nil {
 		PrintVerboseInfo("PackageManager.GetUserAgreementStatus", "user has not accepted the agreement")
 		return false
 	}
 
+	if policy != nil && record.Timestamp.Before(policy.RequiredSince) {
+		PrintVerboseInfo("PackageManager.GetUserAgreementStatus", "the policy requires the agreement to be accepted again")
+		return false
+	}
+
+	if record.Version < requiredAgreementVersion(record) {
+		PrintVerboseInfo("PackageManager.GetUserAgreementStatus", "user has accepted an outdated agreement")
+		return false
+	}
+
 	PrintVerboseInfo("PackageManager.GetUserAgreementStatus", "user has accepted the agreement")
 	return true
 }
 
-// CheckStatus checks if the package manager is enabled or not
+// CheckStatus checks if the package manager is enabled or not. In agreement
+// mode, ErrAgreementNotAccepted is returned until the user accepts the
+// current agreement, so an agreement accepted for an older
+// settings.Cnf.IPkgMngAgreementVersion counts as not accepted
 func (p *PackageManager) CheckStatus() error {
 	PrintVerboseInfo("PackageManager.CheckStatus", "running...")
 
@@ -779,8 +4125,7 @@ func (p *PackageManager) CheckStatus() error {
 	if p.Status == PKG_MNG_REQ_AGREEMENT {
 		if !p.GetUserAgreementStatus() {
 			PrintVerboseInfo("PackageManager.CheckStatus", "package manager agreement not accepted")
-			err := errors.New("package manager agreement not accepted")
-			return err
+			return ErrAgreementNotAccepted
 		}
 	}
 
@@ -313,7 +313,12 @@ func (s *ABSystem) RunOperation(operation ABSystemOperation) error {
 		return err
 	}
 
-	pkgsFinal := pkgM.GetFinalCmd(operation)
+	plan, err := pkgM.BuildCommandPlan(operation)
+	if err != nil {
+		PrintVerboseErr("ABSystemRunOperation", 3.21, err)
+		return err
+	}
+	pkgsFinal := plan.Cmd
 	if pkgsFinal == "" {
 		pkgsFinal = "true"
 	}
@@ -413,6 +418,10 @@ func (s *ABSystem) RunOperation(operation ABSystemOperation) error {
 	}
 
 	cq.Add(func(args ...interface{}) error {
+		err := pkgM.RecordLastApply()
+		if err != nil {
+			PrintVerboseErr("ABSystem.RunOperation", 4.3, err)
+		}
 		return pkgM.ClearUnstagedPackages()
 	}, nil, 10, &goodies.NoErrorHandler{}, false)
 
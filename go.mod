@@ -9,6 +9,7 @@ require (
 	github.com/containers/image/v5 v5.30.1
 	github.com/containers/storage v1.53.0
 	github.com/dustin/go-humanize v1.0.1
+	github.com/fsnotify/fsnotify v1.7.0
 	github.com/google/uuid v1.6.0
 	github.com/hashicorp/go-version v1.6.0
 	github.com/linux-immutability-tools/EtcBuilder v1.3.0
@@ -20,6 +21,7 @@ require (
 	github.com/vanilla-os/orchid v0.6.0
 	github.com/vanilla-os/prometheus v1.0.2
 	github.com/vanilla-os/sdk v0.0.0-20240424182549-7fbf2ce02046
+	golang.org/x/sync v0.6.0
 	golang.org/x/sys v0.22.0
 )
 
@@ -64,7 +66,6 @@ require (
 	github.com/docker/go-units v0.5.0 // indirect
 	github.com/felixge/httpsnoop v1.0.4 // indirect
 	github.com/fitv/go-i18n v1.0.4 // indirect
-	github.com/fsnotify/fsnotify v1.7.0 // indirect
 	github.com/fsouza/go-dockerclient v1.10.1 // indirect
 	github.com/go-jose/go-jose/v3 v3.0.3 // indirect
 	github.com/go-logr/logr v1.4.1 // indirect
@@ -172,7 +173,6 @@ require (
 	golang.org/x/exp v0.0.0-20240222234643-814bf88cf225 // indirect
 	golang.org/x/mod v0.15.0 // indirect
 	golang.org/x/net v0.23.0 // indirect
-	golang.org/x/sync v0.6.0 // indirect
 	golang.org/x/term v0.18.0 // indirect
 	golang.org/x/text v0.14.0 // indirect
 	golang.org/x/tools v0.18.0 // indirect
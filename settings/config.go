@@ -17,6 +17,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"slices"
+	"strings"
 
 	"github.com/spf13/viper"
 )
@@ -39,6 +41,52 @@ type Config struct {
 	IPkgMngRm     string `json:"iPkgMngRm"`
 	IPkgMngApi    string `json:"iPkgMngApi"`
 	IPkgMngStatus int    `json:"iPkgMngStatus"`
+	IPkgMngBranch string `json:"iPkgMngBranch"`
+
+	IPkgMngArch    string `json:"iPkgMngArch"`
+	IPkgMngRelease string `json:"iPkgMngRelease"`
+
+	IPkgMngApiExpectJSON bool `json:"iPkgMngApiExpectJSON"`
+	IPkgMngOffline       bool `json:"iPkgMngOffline"`
+
+	IPkgMngApiFallbacks     []string `json:"iPkgMngApiFallbacks"`
+	IPkgMngApiFallbackOn404 bool     `json:"iPkgMngApiFallbackOn404"`
+
+	IPkgMngApiHeaders map[string]string `json:"iPkgMngApiHeaders"`
+	IPkgMngApiIndex   string            `json:"iPkgMngApiIndex"`
+
+	IPkgMngApiSuccessCodes []int `json:"iPkgMngApiSuccessCodes"`
+
+	IPkgMngOkExitCodes   []int    `json:"iPkgMngOkExitCodes"`
+	IPkgMngPreCmds       []string `json:"iPkgMngPreCmds"`
+	IPkgMngPostCmds      []string `json:"iPkgMngPostCmds"`
+	IPkgMngMaxPkgsPerCmd int      `json:"iPkgMngMaxPkgsPerCmd"`
+	IPkgMngVersionFormat string   `json:"iPkgMngVersionFormat"`
+
+	IPkgMngAgreementVersion   int  `json:"iPkgMngAgreementVersion"`
+	IPkgMngApplyUsesCommitted bool `json:"iPkgMngApplyUsesCommitted"`
+	IPkgMngTrace              bool `json:"iPkgMngTrace"`
+	IPkgMngCheckBinaries      bool `json:"iPkgMngCheckBinaries"`
+	IPkgMngCheckInstalled     bool `json:"iPkgMngCheckInstalled"`
+	IPkgMngStrictApi          bool `json:"iPkgMngStrictApi"`
+	IPkgMngOrderByDeps        bool `json:"iPkgMngOrderByDeps"`
+
+	IPkgMngSummaryTemplate string `json:"iPkgMngSummaryTemplate"`
+
+	IPkgMngMaxIdleConnsPerHost int  `json:"iPkgMngMaxIdleConnsPerHost"`
+	IPkgMngKeepAlive           int  `json:"iPkgMngKeepAlive"`
+	IPkgMngHTTP2               bool `json:"iPkgMngHTTP2"`
+	IPkgMngMaxConns            int  `json:"iPkgMngMaxConns"`
+	IPkgMngTimeout             int  `json:"iPkgMngTimeout"`
+	IPkgMngRetryAttempts       int  `json:"iPkgMngRetryAttempts"`
+	IPkgMngRetryDelay          int  `json:"iPkgMngRetryDelay"`
+	IPkgMngRetryBudget         int  `json:"iPkgMngRetryBudget"`
+	IPkgMngCacheTTL            int  `json:"iPkgMngCacheTTL"`
+
+	IPkgMngAllowedLicenses []string `json:"iPkgMngAllowedLicenses"`
+	IPkgMngStrictLicenses  bool     `json:"iPkgMngStrictLicenses"`
+
+	IPkgMngAgreementPolicyFile string `json:"iPkgMngAgreementPolicyFile"`
 
 	// Boot configuration commands
 	UpdateInitramfsCmd string `json:"updateInitramfsCmd"`
@@ -66,6 +114,21 @@ type Config struct {
 var Cnf *Config
 var CnfFileUsed string
 
+// EnvPrefix is the prefix of the environment variables overriding the
+// configuration, e.g. ABROOT_IPKGMNGTIMEOUT for iPkgMngTimeout
+const EnvPrefix = "ABROOT"
+
+// EnvKeys are the only configuration keys which can be overridden by an
+// environment variable. The commands and the repo API are left out on
+// purpose, since they are run or trusted as root
+var EnvKeys = []string{
+	"iPkgMngTimeout",
+	"iPkgMngRetryAttempts",
+	"iPkgMngRetryDelay",
+	"iPkgMngMaxConns",
+	"iPkgMngCacheTTL",
+}
+
 func init() {
 	// user paths
 	homedir, _ := os.UserHomeDir()
@@ -82,10 +145,32 @@ func init() {
 	viper.SetConfigName("abroot")
 	viper.SetConfigType("json")
 
+	// environment variables override the configuration file for EnvKeys
+	viper.SetEnvPrefix(EnvPrefix)
+	for _, key := range EnvKeys {
+		viper.BindEnv(key)
+	}
+
 	// VanillaOS specific defaults for backwards compatibility
 	viper.SetDefault("updateInitramfsCmd", "lpkg --unlock && /usr/sbin/update-initramfs -u && lpkg --lock")
 	viper.SetDefault("updateGrubCmd", "/usr/sbin/grub-mkconfig -o '%s'")
 
+	// Package manager defaults
+	viper.SetDefault("iPkgMngOkExitCodes", []int{0})
+	viper.SetDefault("iPkgMngSummaryTemplate", "Will install {addCount} packages and remove {removeCount}.")
+	viper.SetDefault("iPkgMngMaxIdleConnsPerHost", 4)
+	viper.SetDefault("iPkgMngKeepAlive", 30)
+	viper.SetDefault("iPkgMngHTTP2", true)
+	viper.SetDefault("iPkgMngMaxConns", 8)
+	viper.SetDefault("iPkgMngTimeout", 30)
+	viper.SetDefault("iPkgMngRetryAttempts", 3)
+	viper.SetDefault("iPkgMngRetryDelay", 500)
+	viper.SetDefault("iPkgMngRetryBudget", 10)
+	viper.SetDefault("iPkgMngCacheTTL", 60)
+	viper.SetDefault("iPkgMngApiFallbackOn404", true)
+	viper.SetDefault("iPkgMngApiSuccessCodes", []int{200})
+	viper.SetDefault("iPkgMngVersionFormat", "{packageName}={version}")
+
 	err := viper.ReadInConfig()
 	if err != nil {
 		return
@@ -111,6 +196,52 @@ func init() {
 		IPkgMngRm:     viper.GetString("iPkgMngRm"),
 		IPkgMngApi:    viper.GetString("iPkgMngApi"),
 		IPkgMngStatus: viper.GetInt("iPkgMngStatus"),
+		IPkgMngBranch: viper.GetString("iPkgMngBranch"),
+
+		IPkgMngArch:    viper.GetString("iPkgMngArch"),
+		IPkgMngRelease: viper.GetString("iPkgMngRelease"),
+
+		IPkgMngApiExpectJSON: viper.GetBool("iPkgMngApiExpectJSON"),
+		IPkgMngOffline:       viper.GetBool("iPkgMngOffline"),
+
+		IPkgMngApiFallbacks:     viper.GetStringSlice("iPkgMngApiFallbacks"),
+		IPkgMngApiFallbackOn404: viper.GetBool("iPkgMngApiFallbackOn404"),
+
+		IPkgMngApiHeaders: viper.GetStringMapString("iPkgMngApiHeaders"),
+		IPkgMngApiIndex:   viper.GetString("iPkgMngApiIndex"),
+
+		IPkgMngApiSuccessCodes: viper.GetIntSlice("iPkgMngApiSuccessCodes"),
+
+		IPkgMngOkExitCodes:   viper.GetIntSlice("iPkgMngOkExitCodes"),
+		IPkgMngPreCmds:       viper.GetStringSlice("iPkgMngPreCmds"),
+		IPkgMngPostCmds:      viper.GetStringSlice("iPkgMngPostCmds"),
+		IPkgMngMaxPkgsPerCmd: viper.GetInt("iPkgMngMaxPkgsPerCmd"),
+		IPkgMngVersionFormat: viper.GetString("iPkgMngVersionFormat"),
+
+		IPkgMngAgreementVersion:   viper.GetInt("iPkgMngAgreementVersion"),
+		IPkgMngApplyUsesCommitted: viper.GetBool("iPkgMngApplyUsesCommitted"),
+		IPkgMngTrace:              viper.GetBool("iPkgMngTrace"),
+		IPkgMngCheckBinaries:      viper.GetBool("iPkgMngCheckBinaries"),
+		IPkgMngCheckInstalled:     viper.GetBool("iPkgMngCheckInstalled"),
+		IPkgMngStrictApi:          viper.GetBool("iPkgMngStrictApi"),
+		IPkgMngOrderByDeps:        viper.GetBool("iPkgMngOrderByDeps"),
+
+		IPkgMngSummaryTemplate: viper.GetString("iPkgMngSummaryTemplate"),
+
+		IPkgMngMaxIdleConnsPerHost: viper.GetInt("iPkgMngMaxIdleConnsPerHost"),
+		IPkgMngKeepAlive:           viper.GetInt("iPkgMngKeepAlive"),
+		IPkgMngHTTP2:               viper.GetBool("iPkgMngHTTP2"),
+		IPkgMngMaxConns:            viper.GetInt("iPkgMngMaxConns"),
+		IPkgMngTimeout:             viper.GetInt("iPkgMngTimeout"),
+		IPkgMngRetryAttempts:       viper.GetInt("iPkgMngRetryAttempts"),
+		IPkgMngRetryDelay:          viper.GetInt("iPkgMngRetryDelay"),
+		IPkgMngRetryBudget:         viper.GetInt("iPkgMngRetryBudget"),
+		IPkgMngCacheTTL:            viper.GetInt("iPkgMngCacheTTL"),
+
+		IPkgMngAllowedLicenses: viper.GetStringSlice("iPkgMngAllowedLicenses"),
+		IPkgMngStrictLicenses:  viper.GetBool("iPkgMngStrictLicenses"),
+
+		IPkgMngAgreementPolicyFile: viper.GetString("iPkgMngAgreementPolicyFile"),
 
 		// Boot configuration commands
 		UpdateInitramfsCmd: viper.GetString("updateInitramfsCmd"),
@@ -138,6 +269,22 @@ func init() {
 	Cnf.FullImageName = fmt.Sprintf("%s/%s:%s", Cnf.Registry, Cnf.Name, Cnf.Tag)
 }
 
+// Source returns where the value of a configuration key comes from: "env"
+// if it is one of EnvKeys and its environment variable is set, "settings" if
+// it is set in the configuration file or "default" otherwise
+func Source(key string) string {
+	if slices.Contains(EnvKeys, key) {
+		if _, ok := os.LookupEnv(EnvPrefix + "_" + strings.ToUpper(key)); ok {
+			return "env"
+		}
+	}
+	if viper.InConfig(key) {
+		return "settings"
+	}
+
+	return "default"
+}
+
 // WriteConfigToFile writes the current configuration to a file
 func WriteConfigToFile(file string) error {
 	jsonOutput, err := json.MarshalIndent(Cnf, "", "    ")